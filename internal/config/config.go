@@ -1,5 +1,9 @@
 package config
 
+import (
+	"strings"
+)
+
 const (
 	ConfigType      string = "yaml"
 	ConfigFile      string = "config.yml"
@@ -8,11 +12,24 @@ const (
 	ConfigUserAgent string = "confinit"
 )
 
+const (
+	// GlobsLegacy globs: "*" matches any character, also "/"
+	GlobsLegacy string = "legacy"
+	// GlobsPath globs: "*" does not match "/" and "**" matches folders
+	GlobsPath string = "path"
+)
+
 type Permissions struct {
-	Glob  string `mapstructure:"glob" valid:"glob,configuration" default:"*"`
-	Mode  string `mapstructure:"mode" default:"0"`
-	User  string `mapstructure:"user" valid:"user"`
-	Group string `mapstructure:"group" valid:"group"`
+	Glob         []string          `mapstructure:"glob" valid:"glob,configuration" default:"[\"**\"]"`
+	Mode         string            `mapstructure:"mode" valid:"symbolicmode" default:"0"`
+	User         string            `mapstructure:"user" valid:"user"`
+	Group        string            `mapstructure:"group" valid:"group"`
+	Uid          int               `mapstructure:"uid" default:"-1"`
+	Gid          int               `mapstructure:"gid" default:"-1"`
+	Xattrs       map[string]string `mapstructure:"xattrs"`
+	Capabilities string            `mapstructure:"capabilities" valid:"capabilities"`
+	Type         string            `mapstructure:"type" valid:"in(file|dir|all)" default:"all"`
+	Recursive    *bool             `mapstructure:"recursive" default:"false"`
 }
 
 type DefaultMode struct {
@@ -25,6 +42,16 @@ type Default struct {
 	Force *bool       `mapstructure:"force" default:"true"`
 }
 
+// Parents are the settings of the folders created on the way to the
+// destinations, without them they are inherited from the nearest
+// existing folder if inherit is true
+type Parents struct {
+	Mode    string `mapstructure:"mode" valid:"mode" default:"0"`
+	User    string `mapstructure:"user" valid:"user"`
+	Group   string `mapstructure:"group" valid:"group"`
+	Inherit *bool  `mapstructure:"inherit" default:"false"`
+}
+
 type Delete struct {
 	PreStart     *bool `mapstructure:"prestart" default:"false"`
 	IfEmpty      *bool `mapstructure:"ifempty" default:"true"`
@@ -33,22 +60,89 @@ type Delete struct {
 	AfterExec    *bool `mapstructure:"afterexec" default:"true"`
 }
 
+type Archive struct {
+	StripComponents int               `mapstructure:"strip_components"`
+	Include         []string          `mapstructure:"include"`
+	Exclude         []string          `mapstructure:"exclude"`
+	Owners          map[string]string `mapstructure:"owners"`
+	Groups          map[string]string `mapstructure:"groups"`
+	SameOwner       *bool             `mapstructure:"sameowner" default:"false"`
+}
+
+// Extensions is the delextension setting of an operation, a bool (any
+// extension is removed) or a list of the suffixes to remove
+type Extensions struct {
+	Enabled  *bool    `mapstructure:"enabled" default:"true"`
+	Suffixes []string `mapstructure:"suffixes"`
+}
+
+// Rename rewrites the relative paths matching Regex, Replace can
+// use the groups of the regex ($1, ${name})
+type Rename struct {
+	Regex   string `mapstructure:"regex" valid:"required"`
+	Replace string `mapstructure:"replace"`
+}
+
+// Matches selects the files of an operation by their metadata and
+// content, on top of regex or glob
+type Matches struct {
+	MinSize     int64    `mapstructure:"minsize"`
+	MaxSize     int64    `mapstructure:"maxsize"`
+	Mode        string   `mapstructure:"mode" valid:"mode"`
+	Executable  *bool    `mapstructure:"executable" default:"-"`
+	Content     string   `mapstructure:"content"`
+	ContentSize int64    `mapstructure:"contentsize" default:"64"`
+	Shebang     *bool    `mapstructure:"shebang" default:"-"`
+	Mime        []string `mapstructure:"mime"`
+}
+
+// Defined returns true if some matcher is defined
+func (m *Matches) Defined() bool {
+	return m.MinSize > 0 || m.MaxSize > 0 || m.Mode != "" || m.Executable != nil ||
+		m.Content != "" || m.Shebang != nil || len(m.Mime) > 0
+}
+
 type Operation struct {
+	When            string                 `mapstructure:"when"`
 	DestinationPath string                 `mapstructure:"destination" valid:"configuration"`
+	DestinationTpl  string                 `mapstructure:"destination_template"`
+	Foreach         string                 `mapstructure:"foreach"`
 	Default         Default                `mapstructure:"default"`
 	Perms           []*Permissions         `mapstructure:"permissions"`
+	Parents         Parents                `mapstructure:"parents"`
 	Regex           string                 `mapstructure:"regex" default:".*"`
+	Glob            []string               `mapstructure:"glob" valid:"glob"`
+	Matches         Matches                `mapstructure:"matches"`
 	Data            map[string]interface{} `mapstructure:"data"`
 	Template        *bool                  `mapstructure:"template" default:"true"`
-	DelExtension    *bool                  `mapstructure:"delextension" default:"true"`
+	Binary          string                 `mapstructure:"binary" valid:"in(copy|skip|fail)" default:"copy"`
+	DelExtension    Extensions             `mapstructure:"delextension"`
+	Rename          []*Rename              `mapstructure:"rename"`
 	RenderCondition string                 `mapstructure:"condition"`
 	Delete          Delete                 `mapstructure:"delete"`
+	Preserve        []string               `mapstructure:"preserve" valid:"in(mode|owner|times|xattrs)"`
 	Command         *Runner                `mapstructure:"command" valid:"-"`
+	RunParts        *bool                  `mapstructure:"runparts" default:"false"`
+	Concurrency     int                    `mapstructure:"concurrency" valid:"range(0|1024)"`
+	MaxParallel     int                    `mapstructure:"max_parallel" valid:"range(1|1024)" default:"1"`
+	Extract         *bool                  `mapstructure:"extract" default:"false"`
+	Archive         Archive                `mapstructure:"archive"`
+}
+
+type Download struct {
+	URL             string         `mapstructure:"url" valid:"configuration"`
+	DestinationPath string         `mapstructure:"destination" valid:"required"`
+	Checksum        string         `mapstructure:"checksum"`
+	Retries         int            `mapstructure:"retries" default:"3"`
+	Timeout         int            `mapstructure:"timeout" default:"60"`
+	Default         Default        `mapstructure:"default"`
+	Perms           []*Permissions `mapstructure:"permissions"`
 }
 
+// MatchItem globs, without add globs everything is added
 type MatchItem struct {
-	Add  string `mapstructure:"add" valid:"glob" default:"*"`
-	Skip string `mapstructure:"skip" valid:"glob"`
+	Add  []string `mapstructure:"add" valid:"glob"`
+	Skip []string `mapstructure:"skip" valid:"glob"`
 }
 
 type Match struct {
@@ -57,13 +151,33 @@ type Match struct {
 }
 
 type Process struct {
-	Source      string       `mapstructure:"source" valid:"required"`
-	Match       Match        `mapstructure:"match" valid:"required"`
+	When        string       `mapstructure:"when"`
+	Source      string       `mapstructure:"source"`
+	Sources     []string     `mapstructure:"sources"`
+	Checksum    string       `mapstructure:"checksum"`
+	Match       Match        `mapstructure:"match"`
+	IgnoreFile  string       `mapstructure:"ignorefile"`
+	Order       string       `mapstructure:"order" valid:"in(lexical|natural)" default:"lexical"`
+	Concurrency int          `mapstructure:"concurrency" valid:"range(1|1024)" default:"1"`
 	ExcludeDone *bool        `mapstructure:"excludedone" default:"true"`
-	Operations  []*Operation `mapstructure:"operations" valid:"required"`
+	Downloads   []*Download  `mapstructure:"downloads"`
+	Operations  []*Operation `mapstructure:"operations" valid:"required,configuration"`
+}
+
+// Name describes the source(s) of the process
+func (p *Process) Name() string {
+	if len(p.Sources) == 0 {
+		return p.Source
+	}
+	if p.Source == "" {
+		return strings.Join(p.Sources, ",")
+	}
+	return p.Source + "," + strings.Join(p.Sources, ",")
 }
 
 type Runner struct {
+	// When is only used by start and finish, operations have their own
+	When    string            `mapstructure:"when"`
 	Cmd     []string          `mapstructure:"cmd"`
 	Timeout int               `mapstructure:"timeout" default:"300"`
 	Env     map[string]string `mapstructure:"env"`
@@ -76,7 +190,12 @@ type Config struct {
 	LogLevel  string            `mapstructure:"loglevel" valid:"in(debug|info|warn|error|panic|fatal),required" default:"info" flag:"program log level"`
 	Env       map[string]string `mapstructure:"env"`
 	DataFile  string            `mapstructure:"datafile" flag:"file for global template data key/values"`
-	Start     *Runner           `mapstructure:"start"`
-	Finish    *Runner           `mapstructure:"finish"`
-	Process   []Process         `mapstructure:"process"`
+	StateFile string            `mapstructure:"statefile" default:"/var/lib/confinit/state.json" flag:"file to keep track of the files created in each run"`
+	Prune     string            `mapstructure:"prune" valid:"in(off|report|delete)" default:"off" flag:"delete (or report) files created in previous runs whose source is gone: off, report, delete"`
+	Globs     string            `mapstructure:"globs" valid:"in(legacy|path)" default:"legacy"`
+	// Incremental skips the copies of the items which did not change since the previous run
+	Incremental bool      `mapstructure:"incremental" default:"false" flag:"only copy the files changed since the previous run, templates are always rendered (needs statefile)"`
+	Start       *Runner   `mapstructure:"start"`
+	Finish      *Runner   `mapstructure:"finish"`
+	Process     []Process `mapstructure:"process"`
 }
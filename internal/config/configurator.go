@@ -7,6 +7,7 @@ import (
 	"github.com/spf13/viper"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"confinit/pkg/log"
@@ -52,6 +53,10 @@ func NewConfigurator(version, configArg string, cmd *cobra.Command) Configurator
 	inspectConfig(reflect.ValueOf(new(Config)), "flag", "", ".", m)
 	for key, value := range m {
 		cmd.PersistentFlags().String(key, "", value.(string))
+		if boolField(key) {
+			// --key is the same as --key=true
+			cmd.PersistentFlags().Lookup(key).NoOptDefVal = "true"
+		}
 		if err := c.BindFlagCommand(true, key, cmd); err != nil {
 			log.Panicf("Could not bind global flag: %s", err)
 		}
@@ -105,6 +110,50 @@ func (c *configurator) GetConfigFile(def bool) string {
 	return filepath.Join(c.PathConfig, c.FileConfig)
 }
 
+// stringToList converts a single string in a list with one element. Unlike
+// the default viper hook, the string is not split by commas, which are
+// part of the glob expressions.
+func stringToList(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+	if f.Kind() != reflect.String || t.Kind() != reflect.Slice || t.Elem().Kind() != reflect.String {
+		return data, nil
+	}
+	value := reflect.ValueOf(data).String()
+	if value == "" {
+		return []string{}, nil
+	}
+	return []string{value}, nil
+}
+
+// boolOrList converts the bool or list settings (delextension) to
+// their struct
+func boolOrList(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+	if f == nil || t != reflect.TypeOf(Extensions{}) {
+		return data, nil
+	}
+	switch f.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"enabled": data}, nil
+	case reflect.String:
+		value := reflect.ValueOf(data).String()
+		if b, err := strconv.ParseBool(value); err == nil {
+			return map[string]interface{}{"enabled": b}, nil
+		}
+		return map[string]interface{}{"enabled": true, "suffixes": []string{value}}, nil
+	case reflect.Slice:
+		return map[string]interface{}{"enabled": true, "suffixes": data}, nil
+	}
+	return data, nil
+}
+
+// decodeHook applies all the conversions of the configuration values
+func decodeHook(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+	data, err := boolOrList(f, t, data)
+	if err != nil {
+		return nil, err
+	}
+	return stringToList(reflect.TypeOf(data), t, data)
+}
+
 // Load attempts to populate the struct with configuration values.
 // The value passed to load must be a struct reference or an error
 // will be returned.
@@ -121,7 +170,7 @@ func (c *configurator) LoadConfig(key string) (*Config, error) {
 	}
 	ctxlog := log.WithField("configfile", c.viper.ConfigFileUsed())
 	ctxlog.Debug("Loading configuration")
-	if err := c.viper.Unmarshal(cfg); err != nil {
+	if err := c.viper.Unmarshal(cfg, viper.DecodeHook(decodeHook)); err != nil {
 		ctxlog.Fatalf("Format of configuration file not correct, %s", err.Error())
 		return nil, err
 	}
@@ -185,6 +234,18 @@ func (c *configurator) GetConfigMap(ptr interface{}) (map[string]interface{}, er
 	return m, nil
 }
 
+// boolField returns true if the top level field of Config with the
+// mapstructure name key is a bool
+func boolField(key string) bool {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("mapstructure") == key {
+			return t.Field(i).Type.Kind() == reflect.Bool
+		}
+	}
+	return false
+}
+
 // Builds a map 'dict' from a struct with the fields tagged by 'flag', the map
 // will filled will all keys prefixed by 'root' if is not empty. If 'sep'
 // is defined it will be a flat map (k: v) otherwise is recursive.
@@ -3,13 +3,13 @@ package config
 import (
 	//"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/user"
+	"net/url"
 	"regexp"
-	"strconv"
+	"strings"
 
+	"confinit/pkg/archive"
 	"confinit/pkg/fs"
+	"confinit/pkg/fs/actions"
 	"confinit/pkg/log"
 
 	validator "github.com/asaskevich/govalidator"
@@ -21,9 +21,11 @@ func init() {
 	// valid:"email,optional")
 	validator.SetFieldsRequiredByDefault(false)
 	validator.TagMap["mode"] = validator.Validator(validateMode)
+	validator.TagMap["symbolicmode"] = validator.Validator(validateSymbolicMode)
 	validator.TagMap["user"] = validator.Validator(validateUser)
 	validator.TagMap["group"] = validator.Validator(validateGroup)
 	validator.TagMap["glob"] = validator.Validator(validateGlob)
+	validator.TagMap["capabilities"] = validator.Validator(validateCapabilities)
 	// Structs
 	validator.CustomTypeTagMap.Set("configuration",
 		validator.CustomTypeValidator(
@@ -37,18 +39,48 @@ func init() {
 					if err := c.Validate(); err == nil {
 						return true
 					}
+				case Download:
+					if err := c.Validate(); err == nil {
+						return true
+					}
+				case Process:
+					if err := c.Validate(); err == nil {
+						return true
+					}
 				}
 				return false
 			}))
 }
 
 // Validate Permissions
+// (called by ValidateStruct, the fields are validated by their tags)
 func (p *Permissions) Validate() error {
-	_, err := validator.ValidateStruct(p)
-	if err != nil {
+	var err error
+	if p.Uid < -1 || p.Gid < -1 {
+		err = fmt.Errorf("Invalid uid (%d) or gid (%d), -1 means no fallback", p.Uid, p.Gid)
 		log.Error(err)
 		return err
 	}
+	for name := range p.Xattrs {
+		ns := strings.SplitN(name, ".", 2)
+		if len(ns) != 2 || ns[1] == "" {
+			err = fmt.Errorf("Invalid extended attribute '%s', it needs a namespace like 'user.'", name)
+			log.Error(err)
+			return err
+		}
+		switch ns[0] {
+		case "user", "trusted", "security", "system":
+		default:
+			err = fmt.Errorf("Invalid extended attribute '%s', unknown namespace '%s'", name, ns[0])
+			log.Error(err)
+			return err
+		}
+		if name == fs.CapabilityXattr {
+			err = fmt.Errorf("Invalid extended attribute '%s', use capabilities", name)
+			log.Error(err)
+			return err
+		}
+	}
 	return nil
 }
 
@@ -60,46 +92,49 @@ func validateGlob(s string) bool {
 	return true
 }
 
-func validateMode(s string) bool {
-	// // Create a Temp File to check mode
-	tmpFile, err := ioutil.TempFile(os.TempDir(), "fs-check-*")
-	if err != nil {
-		log.Errorf("Cannot create temporary file, %s", err.Error())
+func validateCapabilities(s string) bool {
+	if _, err := fs.ParseCapabilities(s); err != nil {
+		log.Error(err)
 		return false
 	}
-	defer os.Remove(tmpFile.Name())
-	mode, err := strconv.ParseUint(s, 8, 32)
+	return true
+}
+
+// validateMode only accepts octal modes
+func validateMode(s string) bool {
+	mode, err := fs.ParseMode(s)
+	if err == nil && mode.Symbolic() {
+		err = fmt.Errorf("Invalid mode '%s', it must be octal", s)
+	}
 	if err != nil {
-		log.Errorf("Cannot parse mode, %s", err)
+		log.Error(err)
 		return false
 	}
-	if err := tmpFile.Chmod(os.FileMode(mode)); err != nil {
-		log.Errorf("Invalid mode, %s", err.Error())
+	return true
+}
+
+// validateSymbolicMode accepts octal and chmod symbolic modes
+func validateSymbolicMode(s string) bool {
+	if _, err := fs.ParseMode(s); err != nil {
+		log.Error(err)
 		return false
 	}
 	return true
 }
 
+// validateUser only warns about unknown users, they are resolved when
+// they are needed because they can be created by previous steps
 func validateUser(s string) bool {
-	_, err := user.LookupId(s)
-	if err != nil {
-		_, err = user.Lookup(s)
-		if err != nil {
-			log.Errorf("Invalid %s", err.Error())
-			return false
-		}
+	if _, err := fs.LookupUser(s); err != nil {
+		log.Warnf("%s, it must exist when it is applied", err)
 	}
 	return true
 }
 
+// validateGroup only warns about unknown groups, like validateUser
 func validateGroup(s string) bool {
-	_, err := user.LookupGroupId(s)
-	if err != nil {
-		_, err = user.LookupGroup(s)
-		if err != nil {
-			log.Errorf("Invalid %s", err.Error())
-			return false
-		}
+	if _, err := fs.LookupGroup(s); err != nil {
+		log.Warnf("%s, it must exist when it is applied", err)
 	}
 	return true
 }
@@ -120,6 +155,34 @@ func (o *Operation) Validate() error {
 			return err
 		}
 	}
+	for _, pe := range o.Perms {
+		if _, err := validator.ValidateStruct(pe); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	for _, r := range o.Rename {
+		if _, err := validator.ValidateStruct(r); err != nil {
+			log.Error(err)
+			return err
+		}
+		if _, err := regexp.Compile(r.Regex); err != nil {
+			err = fmt.Errorf("Invalid rename pattern '%s', %s", r.Regex, err)
+			log.Error(err)
+			return err
+		}
+	}
+	if err := o.Matches.Validate(); err != nil {
+		log.Error(err)
+		return err
+	}
+	for _, s := range o.DelExtension.Suffixes {
+		if s == "" || strings.Contains(s, "/") {
+			err := fmt.Errorf("Invalid delextension suffix '%s'", s)
+			log.Error(err)
+			return err
+		}
+	}
 	if o.Command != nil {
 		_, err := validator.ValidateStruct(o.Command)
 		if err != nil {
@@ -127,12 +190,112 @@ func (o *Operation) Validate() error {
 			return err
 		}
 	}
+	if o.Extract != nil && *o.Extract {
+		if o.DestinationPath == "" {
+			return fmt.Errorf("Extract needs a destination")
+		}
+		if _, err := archive.NewExtractor(o.Archive.StripComponents, o.Archive.Include, o.Archive.Exclude); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
 	if o.DestinationPath == "" && o.Command == nil {
 		return fmt.Errorf("Action not valid")
 	}
 	return nil
 }
 
+// Validate Matches
+func (m *Matches) Validate() error {
+	if _, err := validator.ValidateStruct(m); err != nil {
+		return err
+	}
+	if m.MinSize < 0 || m.MaxSize < 0 || m.ContentSize < 0 {
+		return fmt.Errorf("Invalid matches, sizes cannot be negative")
+	}
+	if m.MaxSize > 0 && m.MinSize > m.MaxSize {
+		return fmt.Errorf("Invalid matches, minsize %d is greater than maxsize %d", m.MinSize, m.MaxSize)
+	}
+	if _, err := regexp.Compile(m.Content); err != nil {
+		return fmt.Errorf("Invalid content pattern '%s', %s", m.Content, err)
+	}
+	return nil
+}
+
+// Validate Download
+func (d *Download) Validate() error {
+	if !ValidUrl(d.URL) {
+		err := fmt.Errorf("Invalid url: %s", d.URL)
+		log.Error(err)
+		return err
+	}
+	if _, err := actions.ParseChecksum(d.Checksum); err != nil {
+		log.Error(err)
+		return err
+	}
+	for _, pe := range d.Perms {
+		if _, err := validator.ValidateStruct(pe); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate Process
+func (p *Process) Validate() error {
+	if p.Source == "" && len(p.Sources) == 0 {
+		err := fmt.Errorf("Process without source")
+		log.Error(err)
+		return err
+	}
+	for _, s := range p.Sources {
+		if ValidUrl(s) {
+			err := fmt.Errorf("Source url '%s' not allowed in sources, only in source", s)
+			log.Error(err)
+			return err
+		}
+	}
+	if _, err := actions.ParseChecksum(p.Checksum); err != nil {
+		log.Error(err)
+		return err
+	}
+	// govalidator does not check the elements of lists of pointers
+	for _, o := range p.Operations {
+		if _, err := validator.ValidateStruct(o); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	for _, d := range p.Downloads {
+		if _, err := validator.ValidateStruct(d); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	// the ignore file is read when the process runs, it can be
+	// created by the downloads or the sources of previous processes
+	if p.IgnoreFile != "" && (ValidUrl(p.IgnoreFile) || strings.ContainsRune(p.IgnoreFile, 0)) {
+		err := fmt.Errorf("Invalid ignore file path '%s'", p.IgnoreFile)
+		log.Error(err)
+		return err
+	}
+	if ValidUrl(p.Source) {
+		u, _ := url.Parse(p.Source)
+		if !archive.IsArchive(u.Path) {
+			err := fmt.Errorf("Source url '%s' is not an archive", p.Source)
+			log.Error(err)
+			return err
+		}
+		if p.Checksum == "" {
+			err := fmt.Errorf("Source url '%s' needs a checksum", p.Source)
+			log.Error(err)
+			return err
+		}
+	}
+	return nil
+}
+
 // Validate Config the application's configuration
 func (c *Config) Validate() error {
 	if _, err := validator.ValidateStruct(c); err != nil {
@@ -4,14 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 
 	"confinit/internal/config"
+	"confinit/pkg/archive"
 	"confinit/pkg/fs"
 	"confinit/pkg/fs/actions"
 	"confinit/pkg/runner"
+	"confinit/pkg/state"
 
 	"github.com/spf13/cobra"
 )
@@ -22,6 +26,15 @@ type Program struct {
 	Data         interface{}
 	ConfigArg    string
 	Configurator config.Configurator
+	state        *state.State
+	created      *state.State
+	operations   map[string]bool
+	expanded     map[string]bool
+	elements     map[string]bool
+	binaries     map[string]string
+	facts        map[string]interface{}
+	index        *fs.Index
+	scans        map[string]*fs.Fs
 }
 
 func NewProgram(build, version, configArg string, command *cobra.Command) *Program {
@@ -102,9 +115,13 @@ func (p *Program) RunAll() (err error) {
 		err = p.LoadData()
 		if err == nil {
 			rcs[fmt.Sprintf("%s_RC_LOAD_DATA", config.ConfigEnv)] = 0
+			p.LoadState()
 			rcP, errP := p.Process()
 			rcs[fmt.Sprintf("%s_RC_PROCESS", config.ConfigEnv)] = rcP
 			err = errP
+			if errPrune := p.Prune(rcP); errPrune != nil && err == nil {
+				err = errPrune
+			}
 		} else {
 			rcs[fmt.Sprintf("%s_RC_LOAD_DATA", config.ConfigEnv)] = 1
 		}
@@ -118,13 +135,70 @@ func (p *Program) RunAll() (err error) {
 	return
 }
 
-func (p *Program) operation(f *fs.Fs, c *config.Operation, excludes []string) ([]string, error) {
-	errs := false
+// permissions sets the default modes and the list of permissions, it
+// returns false if some permissions cannot be applied
+func (p *Program) permissions(r *actions.Replicator, d *config.Default, perms []*config.Permissions) bool {
+	ok := true
 	log := p.Configurator.Logger()
-	a, err := actions.NewActionRouter(c.Regex, c.DestinationPath, *c.Default.Force, *c.DelExtension, *c.Template, excludes)
+	dirmode, _ := strconv.ParseUint(d.Mode.Dir, 8, 32)
+	filemode, _ := strconv.ParseUint(d.Mode.File, 8, 32)
+	r.SetDefaultModes(os.FileMode(dirmode), os.FileMode(filemode))
+	r.SetGlobMode(p.Config.Globs == config.GlobsPath)
+	for i, pe := range perms {
+		per, errp := fs.NewPerm(pe.User, pe.Group, 0)
+		if errp == nil {
+			per.SetFallback(pe.Uid, pe.Gid)
+			per.SetXattrs(pe.Xattrs)
+			if errp = per.SetMode(pe.Mode); errp == nil {
+				if errp = per.SetCapabilities(pe.Capabilities); errp == nil {
+					errp = r.SetPermissions(pe.Glob, per, itemType(pe.Type), *pe.Recursive)
+				}
+			}
+		}
+		if errp != nil {
+			log.Errorf("Skipping permissions #%d: %s", i, errp)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// itemType converts the type of a permission rule
+func itemType(t string) fs.FsItemType {
+	switch t {
+	case "file":
+		return fs.FsItemFile
+	case "dir":
+		return fs.FsItemDir
+	}
+	return fs.FsItemAll
+}
+
+func (p *Program) operation(f *fs.Fs, c *config.Operation, id string, origins map[string]string, excludes []string) ([]string, error) {
+	a, err := actions.NewActionRouter(c.Regex, c.DestinationPath, *c.Default.Force, *c.DelExtension.Enabled, *c.Template, excludes)
 	if err != nil {
 		return nil, err
 	}
+	if len(c.Glob) > 0 {
+		// glob is an alternative to regex
+		globs, errg := fs.NewGlobs(c.Glob, p.Config.Globs == config.GlobsPath)
+		if errg != nil {
+			return nil, errg
+		}
+		a.SetGlobs(globs)
+	}
+	if c.Matches.Defined() {
+		m := fs.NewMatcher()
+		mode, _ := strconv.ParseUint(c.Matches.Mode, 8, 32)
+		m.Mode = fs.FromUnixMode(uint32(mode))
+		m.MinSize, m.MaxSize = c.Matches.MinSize, c.Matches.MaxSize
+		m.Executable, m.Shebang = c.Matches.Executable, c.Matches.Shebang
+		m.Mime = c.Matches.Mime
+		if err = m.SetContent(c.Matches.Content, c.Matches.ContentSize*1024); err != nil {
+			return nil, err
+		}
+		a.SetMatcher(m)
+	}
 	err = a.AddData(p.Data)
 	if err != nil {
 		// Data from datafile
@@ -137,10 +211,30 @@ func (p *Program) operation(f *fs.Fs, c *config.Operation, excludes []string) ([
 		err = fmt.Errorf("Adding Data from operation configuration: %s", err)
 		return nil, err
 	}
-	dirmode, _ := strconv.ParseUint(c.Default.Mode.Dir, 8, 32)
-	filemode, _ := strconv.ParseUint(c.Default.Mode.File, 8, 32)
-	a.SetDefaultModes(os.FileMode(dirmode), os.FileMode(filemode))
+	for dir, origin := range origins {
+		a.SetOrigin(dir, origin)
+	}
+	errs := !p.permissions(a.Replicator, &c.Default, c.Perms)
+	if err = a.SetPreserve(c.Preserve...); err != nil {
+		return nil, err
+	}
+	parentmode, _ := strconv.ParseUint(c.Parents.Mode, 8, 32)
+	a.SetParents(fs.FromUnixMode(uint32(parentmode)), c.Parents.User, c.Parents.Group, *c.Parents.Inherit)
 	a.SetCondition(c.RenderCondition)
+	a.SetDestinationTemplate(c.DestinationTpl)
+	if err = a.SetBinary(c.Binary); err != nil {
+		return nil, err
+	}
+	a.SetExtensions(c.DelExtension.Suffixes...)
+	for _, r := range c.Rename {
+		if err = a.AddRename(r.Regex, r.Replace); err != nil {
+			return nil, err
+		}
+	}
+	a.SetForeach(c.Foreach)
+	a.SetRunParts(*c.RunParts)
+	a.SetIncremental(p.Config.Incremental && p.index != nil)
+	a.SetParallel(c.Concurrency, c.MaxParallel)
 	if *c.Delete.PreStart {
 		a.SetDelete(actions.DeletePreStart)
 	}
@@ -156,23 +250,22 @@ func (p *Program) operation(f *fs.Fs, c *config.Operation, excludes []string) ([
 	if *c.Delete.IfRenderFail {
 		a.SetDelete(actions.DeleteIfRenderFail)
 	}
-	for i, pe := range c.Perms {
-		mode, _ := strconv.ParseUint(pe.Mode, 8, 32)
-		errp := a.SetPermissions(pe.Glob, pe.User, pe.Group, os.FileMode(mode))
-		if errp != nil {
-			log.Errorf("Skipping permissions #%d: %s", i, errp)
-			errs = true
-		}
-	}
-	if c.Command != nil && len(c.Command.Cmd) > 0 {
+	// Runner is always defined, files can define a command in
+	// their front matter
+	if c.Command != nil {
 		proc := runner.NewRunner(p.Configurator.Logger())
-		proc.Command(c.Command.Cmd)
+		if len(c.Command.Cmd) > 0 {
+			proc.Command(c.Command.Cmd)
+		}
 		envOS := make(map[string]string)
 		for _, e := range os.Environ() {
 			pair := strings.SplitN(e, "=", 2)
 			envOS[pair[0]] = pair[1]
 		}
 		a.SetRunner(proc, envOS, c.Command.Timeout, c.Command.Dir)
+		a.SetExecFactory(func() actions.Execute {
+			return runner.NewRunner(p.Configurator.Logger())
+		})
 		envC := make(map[string]string)
 		for key, value := range c.Command.Env {
 			// viper bug: https://github.com/spf13/viper/issues/373
@@ -180,40 +273,178 @@ func (p *Program) operation(f *fs.Fs, c *config.Operation, excludes []string) ([
 		}
 		a.AddEnv(envC)
 	}
+	if *c.Extract {
+		x, errx := archive.NewExtractor(c.Archive.StripComponents, c.Archive.Include, c.Archive.Exclude)
+		if errx != nil {
+			return nil, errx
+		}
+		x.Owners = c.Archive.Owners
+		x.Groups = c.Archive.Groups
+		x.SameOwner = *c.Archive.SameOwner
+		a.SetExtractor(x)
+		a.Extractor.SetChecksums(p.state.Archives)
+	}
 	err = f.Run(a)
+	if errr := a.ApplyRecursive(); errr != nil && err == nil {
+		err = errr
+	}
+	outputs := a.ListOutputs()
+	processed := a.ListProcessed()
+	for dir := range a.ListCreated() {
+		if _, ok := outputs[dir]; !ok {
+			// folders created on the way to the destinations
+			outputs[dir] = &actions.Output{Source: f.BasePath}
+		}
+		// processed paths are relative like the sources, the folders
+		// outside of the destination keep their path
+		if rel, errr := filepath.Rel(c.DestinationPath, dir); errr == nil && !strings.HasPrefix(rel, "..") {
+			dir = rel
+		}
+		processed = append(processed, dir)
+	}
+	sort.Strings(processed)
+	p.track(id, outputs)
+	for src, decision := range a.ListBinaries() {
+		p.binaries[src] = decision
+	}
+	sources, elements := a.ListExpanded()
+	p.expand(id, sources, elements)
+	if a.Extractor != nil {
+		for k, sum := range a.Extractor.Extracted {
+			p.created.Archives[k] = sum
+		}
+	}
 	if errs && err == nil {
 		err = fmt.Errorf("Not all permissions were applied!")
 	}
-	return a.ListProcessed(), err
+	return processed, err
+}
+
+// scan returns the items of the layers of the process, processes with
+// the same sources and match settings share the scan within a run
+func (p *Program) scan(proc *config.Process, layers []string) (*fs.Fs, error) {
+	log := p.Configurator.Logger()
+	key := fmt.Sprintf("%q:%q:%q:%q:%q:%s:%s", layers,
+		proc.Match.Folder.Skip, proc.Match.Folder.Add, proc.Match.File.Skip, proc.Match.File.Add,
+		proc.IgnoreFile, p.Config.Globs)
+	if f, ok := p.scans[key]; ok {
+		log.Infof("Reusing scan of path: %s", strings.Join(layers, ", "))
+		f.Order = proc.Order
+		f.Workers = proc.Concurrency
+		return f, nil
+	}
+	var ign *fs.Ignore
+	if proc.IgnoreFile != "" {
+		var err error
+		if ign, err = fs.ReadIgnore(proc.IgnoreFile, "."); err != nil {
+			return nil, fmt.Errorf("Invalid ignore file '%s', %s", proc.IgnoreFile, err)
+		}
+	}
+	f := fs.New(
+		fs.PathGlobs(p.Config.Globs == config.GlobsPath),
+		fs.Ordering(proc.Order),
+		fs.Workers(proc.Concurrency),
+		fs.SkipDirGlob(proc.Match.Folder.Skip...),
+		fs.SkipFileGlob(proc.Match.File.Skip...),
+		fs.FileGlob(proc.Match.File.Add...),
+		fs.DirGlob(proc.Match.Folder.Add...),
+		fs.IgnorePatterns(ign),
+		fs.ScanIndex(p.index),
+	)
+	log.Infof("Scanning path: %s", strings.Join(layers, ", "))
+	if err := f.ScanLayers(layers); err != nil {
+		return f, err
+	}
+	p.scans[key] = f
+	return f, nil
+}
+
+// loadIndex reads the scan index of the previous run, it is kept next
+// to the state file
+func (p *Program) loadIndex() {
+	log := p.Configurator.Logger()
+	p.index = nil
+	if p.Config.StateFile == "" {
+		if p.Config.Incremental {
+			log.Warnf("Incremental mode needs a state file, processing everything")
+		}
+		return
+	}
+	idx, err := fs.LoadIndex(filepath.Join(filepath.Dir(p.Config.StateFile), fs.IndexFile))
+	if err != nil {
+		log.Errorf("Cannot load scan index, processing everything: %s", err)
+	}
+	p.index = idx
 }
 
 func (p *Program) Process() (int, error) {
 	log := p.Configurator.Logger()
 	errs := []error{}
 	processed := []string{}
+	p.scans = make(map[string]*fs.Fs)
+	p.binaries = make(map[string]string)
+	p.loadIndex()
 	for i, proc := range p.Config.Process {
-		f := fs.New(
-			fs.SkipDirGlob(proc.Match.Folder.Skip),
-			fs.SkipFileGlob(proc.Match.File.Skip),
-			fs.FileGlob(proc.Match.File.Add),
-			fs.DirGlob(proc.Match.Folder.Add),
-		)
-		log.Infof("Scanning #%d path: %s", i+1, proc.Source)
-		if err := f.Scan(proc.Source); err != nil {
-			errs = append(errs, fmt.Errorf("#%d %s: %s", i+1, proc.Source, err))
+		name := proc.Name()
+		if ok, reason, err := p.when(proc.When, os.Environ()); err != nil || !ok {
+			if err != nil {
+				errs = append(errs, fmt.Errorf("#%d %s: %s", i+1, name, err))
+				log.Error(err)
+			} else {
+				log.Infof("Skipping #%d process %s, %s", i+1, name, reason)
+			}
+			// keep the files of its operations and downloads
+			for _, oper := range proc.Operations {
+				p.operations[operationID(name, oper)] = true
+			}
+			for _, d := range proc.Downloads {
+				p.keepDownload(d)
+			}
+			continue
+		}
+		for j, d := range proc.Downloads {
+			log.Infof("Downloading #%d url: %s", j+1, d.URL)
+			if err := p.download(d); err != nil {
+				errs = append(errs, fmt.Errorf("#%d %s: %s", i+1, d.URL, err))
+				log.Error(err)
+			}
+		}
+		layers, origins, err := p.layers(&proc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("#%d %s: %s", i+1, name, err))
 			log.Error(err)
+			continue
+		}
+		f, err := p.scan(&proc, layers)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("#%d %s: %s", i+1, name, err))
+			log.Error(err)
+			if f == nil {
+				continue
+			}
 		}
 		for j, oper := range proc.Operations {
-			log.Infof("Processing #%d operation in source: %s", j+1, proc.Source)
-			done, err := p.operation(f, oper, processed)
+			id := operationID(name, oper)
+			p.operations[id] = true
+			if ok, reason, err := p.when(oper.When, os.Environ()); err != nil {
+				errs = append(errs, fmt.Errorf("#%d %s: #%d operation: %s", i+1, name, j+1, err))
+				log.Error(err)
+				continue
+			} else if !ok {
+				log.Infof("Skipping #%d operation in source: %s, %s", j+1, strings.Join(layers, ", "), reason)
+				continue
+			}
+			log.Infof("Processing #%d operation in source: %s", j+1, strings.Join(layers, ", "))
+			done, err := p.operation(f, oper, id, origins, processed)
 			if err != nil {
-				errs = append(errs, fmt.Errorf("#%d %s: %s", i+1, proc.Source, err))
+				errs = append(errs, fmt.Errorf("#%d %s: %s", i+1, name, err))
 			}
 			if *proc.ExcludeDone {
 				processed = append(processed, done...)
 			}
 		}
 	}
+	p.report()
 	if len(errs) > 0 {
 		msg := ""
 		for _, e := range errs {
@@ -221,12 +452,50 @@ func (p *Program) Process() (int, error) {
 		}
 		return 1, fmt.Errorf("%s", msg)
 	}
+	if p.index != nil {
+		// only when everything was processed, otherwise failed items
+		// would be skipped in the next run
+		if err := p.index.Save(); err != nil {
+			log.Errorf("Cannot save scan index: %s", err)
+		}
+	}
 	return 0, nil
 }
 
+// report logs a summary of the run: the binary files found by
+// template operations and what was done with them
+func (p *Program) report() {
+	if len(p.binaries) == 0 {
+		return
+	}
+	log := p.Configurator.Logger()
+	srcs := make([]string, 0, len(p.binaries))
+	for src := range p.binaries {
+		srcs = append(srcs, src)
+	}
+	sort.Strings(srcs)
+	log.Infof("Report: %d binary files not rendered as templates", len(srcs))
+	for _, src := range srcs {
+		log.Infof("Report: binary %s, %s", src, p.binaries[src])
+	}
+}
+
 func (p *Program) RunStart() (int, error) {
 	if p.Config.Start != nil && len(p.Config.Start.Cmd) > 0 {
 		log := p.Configurator.Logger()
+		if p.Config.Start.When != "" && p.Data == nil {
+			// data as it is before running start, it can download it
+			if err := p.LoadData(); err != nil {
+				log.Debugf("Data not available for start when, %s", err)
+			}
+		}
+		if ok, reason, err := p.when(p.Config.Start.When, os.Environ()); err != nil {
+			log.Error(err)
+			return 1, err
+		} else if !ok {
+			log.Infof("Skipping startup program, %s", reason)
+			return -1, nil
+		}
 		log.Infof("Running startup program: %s", p.Config.Start.Cmd)
 		return p.runner(p.Config.Start, os.Environ()).Run()
 	}
@@ -237,10 +506,17 @@ func (p *Program) RunFinish(rc map[string]int) (int, error) {
 	if p.Config.Finish != nil && len(p.Config.Finish.Cmd) > 0 {
 		log := p.Configurator.Logger()
 		env := os.Environ()
-		log.Infof("Running finish program %s", p.Config.Finish.Cmd)
 		for key, value := range rc {
 			env = append(env, fmt.Sprintf("%s=%d", key, value))
 		}
+		if ok, reason, err := p.when(p.Config.Finish.When, env); err != nil {
+			log.Error(err)
+			return 1, err
+		} else if !ok {
+			log.Infof("Skipping finish program, %s", reason)
+			return -1, nil
+		}
+		log.Infof("Running finish program %s", p.Config.Finish.Cmd)
 		return p.runner(p.Config.Finish, env).Run()
 	}
 	return -1, nil
@@ -0,0 +1,268 @@
+package program
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"confinit/internal/config"
+	"confinit/pkg/fs"
+
+	"github.com/spf13/cobra"
+)
+
+// newTestProgram returns a program with the default configuration and
+// one process of src with operations, without state
+func newTestProgram(t *testing.T, src string, operations ...*config.Operation) *Program {
+	p := NewProgram("test", "test", "config", &cobra.Command{})
+	p.Init()
+	p.Config.StateFile = ""
+	p.Config.Process = []config.Process{{Source: src, Operations: operations}}
+	if err := p.Config.SetDefaultConfig(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestOperationWithoutMatchesProcessesExecutables(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	if err = os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"run.sh":   "#!/bin/sh\necho {{ .Source }}\n",
+		"plain.sh": "echo {{ .Source }}\n",
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := newTestProgram(t, src, &config.Operation{DestinationPath: dst})
+	op := p.Config.Process[0].Operations[0]
+	if op.Matches.Defined() {
+		t.Fatalf("Matches defined without configuration: %+v", op.Matches)
+	}
+	p.LoadState()
+	if rc, err := p.Process(); rc != 0 || err != nil {
+		t.Fatalf("Process returned %d, %v", rc, err)
+	}
+	for _, name := range []string{"run", "plain"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+			t.Errorf("File %s not rendered: %s", name, err)
+		}
+	}
+}
+
+func TestTemplateKeepsSourceMode(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	if err = os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]os.FileMode{"run.sh.tpl": 0755, "conf.tpl": 0640}
+	for name, mode := range modes {
+		if err = ioutil.WriteFile(filepath.Join(src, name), []byte("{{ .Source }}\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chmod(filepath.Join(src, name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := newTestProgram(t, src, &config.Operation{DestinationPath: dst})
+	p.LoadState()
+	if rc, err := p.Process(); rc != 0 || err != nil {
+		t.Fatalf("Process returned %d, %v", rc, err)
+	}
+	for name, mode := range map[string]os.FileMode{"run.sh": 0755, "conf": 0640} {
+		fi, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Errorf("Mode of %s is %s, expected %s", name, fi.Mode().Perm(), mode)
+		}
+	}
+}
+
+func TestDefaultPermissionGlobMatchesNestedFiles(t *testing.T) {
+	for _, globs := range []string{config.GlobsLegacy, config.GlobsPath} {
+		tmp, err := ioutil.TempDir("", "confinit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+		if err = os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"top", "sub/nested"} {
+			if err = ioutil.WriteFile(filepath.Join(src, name), []byte("conf\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		op := &config.Operation{
+			DestinationPath: dst,
+			Perms:           []*config.Permissions{{Mode: "0700"}},
+		}
+		p := newTestProgram(t, src, op)
+		p.Config.Globs = globs
+		p.LoadState()
+		if rc, err := p.Process(); rc != 0 || err != nil {
+			t.Fatalf("Process returned %d, %v", rc, err)
+		}
+		for _, name := range []string{"top", "sub/nested"} {
+			fi, err := os.Stat(filepath.Join(dst, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0700 {
+				t.Errorf("Globs %s, mode of %s is %s, expected the default glob to match it", globs, name, fi.Mode().Perm())
+			}
+		}
+	}
+}
+
+func TestOperationProcessedIncludesCreatedFolders(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "parent", "dst")
+	if err = os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(src, "sub", "conf"), []byte("conf\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProgram(t, src, &config.Operation{DestinationPath: dst})
+	p.LoadState()
+	p.scans = make(map[string]*fs.Fs)
+	p.binaries = make(map[string]string)
+	proc := &p.Config.Process[0]
+	f, err := p.scan(proc, []string{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := p.operation(f, proc.Operations[0], "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, d := range done {
+		found[d] = true
+	}
+	for _, expected := range []string{"sub", "sub/conf", filepath.Join(tmp, "parent")} {
+		if !found[expected] {
+			t.Errorf("%s not in the processed paths %v", expected, done)
+		}
+	}
+}
+
+func TestIgnoreFileReadWhenProcessRuns(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	if err = os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"app.conf", "old.bak"} {
+		if err = ioutil.WriteFile(filepath.Join(src, name), []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ignore := filepath.Join(tmp, "ignore")
+	p := newTestProgram(t, src, &config.Operation{DestinationPath: dst})
+	p.Config.Process[0].IgnoreFile = ignore
+	// not created yet, it is read when the process runs
+	if err = p.Config.Process[0].Validate(); err != nil {
+		t.Fatalf("Missing ignore file rejected at load: %s", err)
+	}
+	p.LoadState()
+	if rc, err := p.Process(); rc == 0 || err == nil {
+		t.Fatalf("Process without the ignore file did not fail")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "app")); err == nil {
+		t.Errorf("Files processed without the ignore file")
+	}
+	if err = ioutil.WriteFile(ignore, []byte("*.bak\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rc, err := p.Process(); rc != 0 || err != nil {
+		t.Fatalf("Process returned %d, %v", rc, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "app")); err != nil {
+		t.Errorf("File not processed: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "old")); err == nil {
+		t.Errorf("Ignored file processed")
+	}
+}
+
+func TestIncrementalRendersChangedData(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	if err = os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"app.conf":  "name={{ .Data.name }}\n",
+		"plain.txt": "plain\n",
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copies := false
+	datafile := filepath.Join(tmp, "data.yml")
+	p := newTestProgram(t, src,
+		&config.Operation{DestinationPath: dst, Glob: []string{"*.conf"}},
+		&config.Operation{DestinationPath: dst, Glob: []string{"*.txt"}, Template: &copies},
+	)
+	p.Config.StateFile = filepath.Join(tmp, "state.json")
+	p.Config.DataFile = datafile
+	p.Config.Incremental = true
+	for i, name := range []string{"one", "two"} {
+		if err = ioutil.WriteFile(datafile, []byte("name: "+name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = p.LoadData(); err != nil {
+			t.Fatal(err)
+		}
+		p.LoadState()
+		if rc, err := p.Process(); rc != 0 || err != nil {
+			t.Fatalf("Process #%d returned %d, %v", i+1, rc, err)
+		}
+		if out, _ := ioutil.ReadFile(filepath.Join(dst, "app")); string(out) != "name="+name+"\n" {
+			t.Errorf("Run #%d rendered %q with data %s", i+1, out, name)
+		}
+		if i == 0 {
+			// a copy not changed is not copied again
+			if err = ioutil.WriteFile(filepath.Join(dst, "plain.txt"), []byte("local\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if out, _ := ioutil.ReadFile(filepath.Join(dst, "plain.txt")); string(out) != "local\n" {
+		t.Errorf("Unchanged copy processed again, got %q", out)
+	}
+}
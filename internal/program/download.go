@@ -0,0 +1,51 @@
+package program
+
+import (
+	"fmt"
+	"os"
+
+	"confinit/internal/config"
+	"confinit/pkg/fs/actions"
+)
+
+// download gets the url of the configuration into its destination
+func (p *Program) download(c *config.Download) error {
+	d, err := actions.NewDownloader(c.DestinationPath, *c.Default.Force, c.Timeout, c.Retries)
+	if err != nil {
+		return err
+	}
+	errs := !p.permissions(d.Replicator, &c.Default, c.Perms)
+	dst := d.Destination(c.URL)
+	id := downloadID(c)
+	p.operations[id] = true
+	_, errStat := os.Lstat(dst)
+	existed := errStat == nil
+	dst, cache, err := d.Download(c.URL, c.Checksum, p.state.Downloads[dst])
+	if cache != nil {
+		p.created.Downloads[dst] = cache
+	}
+	if err != nil {
+		return err
+	}
+	p.track(id, map[string]*actions.Output{
+		dst: {Source: c.URL, Existed: existed},
+	})
+	if errs {
+		err = fmt.Errorf("Not all permissions were applied!")
+	}
+	return err
+}
+
+// keepDownload keeps the file and the cache of a download which is not
+// done in this run
+func (p *Program) keepDownload(c *config.Download) {
+	p.operations[downloadID(c)] = true
+	d, err := actions.NewDownloader(c.DestinationPath, *c.Default.Force, c.Timeout, c.Retries)
+	if err != nil {
+		return
+	}
+	dst := d.Destination(c.URL)
+	if cache, ok := p.state.Downloads[dst]; ok {
+		p.created.Downloads[dst] = cache
+	}
+}
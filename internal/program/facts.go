@@ -0,0 +1,84 @@
+package program
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"text/template"
+
+	tfunc "confinit/pkg/tplfunctions"
+)
+
+// Facts returns information about the host, available in templates
+func (p *Program) Facts() map[string]interface{} {
+	if p.facts != nil {
+		return p.facts
+	}
+	fqdn, _ := os.Hostname()
+	hostname := strings.SplitN(fqdn, ".", 2)[0]
+	domain := strings.TrimPrefix(strings.TrimPrefix(fqdn, hostname), ".")
+	machineid, _ := ioutil.ReadFile("/etc/machine-id")
+	p.facts = map[string]interface{}{
+		"hostname":  hostname,
+		"fqdn":      fqdn,
+		"domain":    domain,
+		"os":        runtime.GOOS,
+		"arch":      runtime.GOARCH,
+		"machineid": strings.TrimSpace(string(machineid)),
+	}
+	return p.facts
+}
+
+// render evaluates a template string of the configuration with
+// .Data, .Env and .Facts
+func (p *Program) render(name, value string) (string, error) {
+	return p.renderEnv(name, value, os.Environ())
+}
+
+// renderEnv is render with the environment variables osEnv
+func (p *Program) renderEnv(name, value string, osEnv []string) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	env := make(map[string]string)
+	for _, e := range osEnv {
+		pair := strings.SplitN(e, "=", 2)
+		env[pair[0]] = pair[1]
+	}
+	data := map[string]interface{}{
+		"Data":  p.Data,
+		"Env":   env,
+		"Facts": p.Facts(),
+	}
+	var out bytes.Buffer
+	tpl, err := template.New(name).Funcs(tfunc.TemplateFuncMap()).Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if err = tpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// when evaluates the when expression of an operation, process, start or
+// finish. It returns false and the reason if they have to be skipped:
+// empty results, "false", "no", "off", "0" and "<no value>" are false.
+func (p *Program) when(expr string, osEnv []string) (bool, string, error) {
+	if expr == "" {
+		return true, "", nil
+	}
+	out, err := p.renderEnv("when", expr, osEnv)
+	if err != nil {
+		return false, "", fmt.Errorf("Cannot render when '%s', %s", expr, err)
+	}
+	out = strings.TrimSpace(out)
+	switch strings.ToLower(out) {
+	case "", "false", "no", "off", "0", "<no value>":
+		return false, fmt.Sprintf("when '%s' is '%s'", expr, out), nil
+	}
+	return true, "", nil
+}
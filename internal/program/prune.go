@@ -0,0 +1,183 @@
+package program
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"confinit/internal/config"
+	"confinit/pkg/fs/actions"
+	"confinit/pkg/state"
+)
+
+// operationID identifies an operation of a process between runs
+func operationID(source string, c *config.Operation) string {
+	cmd := ""
+	if c.Command != nil {
+		cmd = fmt.Sprintf("%v", c.Command.Cmd)
+	}
+	match := c.Regex
+	if len(c.Glob) > 0 {
+		match = strings.Join(c.Glob, ",")
+	}
+	return fmt.Sprintf("%s:%s:%s:%s", source, c.DestinationPath, match, cmd)
+}
+
+// downloadID identifies a download of a process between runs
+func downloadID(c *config.Download) string {
+	return fmt.Sprintf("download:%s:%s", c.URL, c.DestinationPath)
+}
+
+// LoadState reads the list of files created in previous runs
+func (p *Program) LoadState() {
+	log := p.Configurator.Logger()
+	p.operations = make(map[string]bool)
+	p.expanded = make(map[string]bool)
+	p.elements = make(map[string]bool)
+	p.created = state.New(p.Config.StateFile)
+	p.state = state.New(p.Config.StateFile)
+	if p.Config.StateFile == "" {
+		return
+	}
+	s, err := state.Load(p.Config.StateFile)
+	if err != nil {
+		log.Errorf("Cannot load state, ignoring previous runs: %s", err)
+	}
+	p.state = s
+}
+
+// track records the destinations created by an operation in this run.
+// Files which were already there before confinit wrote them are only
+// tracked if they were created in a previous run.
+func (p *Program) track(id string, outputs map[string]*actions.Output) {
+	log := p.Configurator.Logger()
+	for dst, o := range outputs {
+		if o.Existed && !p.state.Has(dst) {
+			continue
+		}
+		if err := p.created.Add(dst, o.Source, id); err != nil {
+			log.Errorf("Cannot track '%s' in state: %s", dst, err)
+		}
+	}
+}
+
+// expand records the sources rendered per element of a foreach by an
+// operation and the destinations computed for their elements
+func (p *Program) expand(id string, sources, elements map[string]bool) {
+	for src := range sources {
+		p.expanded[id+":"+src] = true
+	}
+	for dst := range elements {
+		p.elements[dst] = true
+	}
+}
+
+// Prune deletes (or reports) the files created in previous runs which
+// were not created in this one because their source or their operation
+// are gone. Files modified by hand since confinit wrote them are kept.
+// Files of foreach elements which are not in the data anymore are
+// always deleted.
+func (p *Program) Prune(rc int) error {
+	if p.created == nil || p.Config.StateFile == "" {
+		return nil
+	}
+	log := p.Configurator.Logger()
+	if rc != 0 {
+		// Sources can be missing because of the errors, do not prune
+		log.Warnf("Skipping prune, there were errors processing sources")
+		p.carry(p.state.Created)
+		p.saveState()
+		return nil
+	}
+	pending := make(map[string]*state.Entry)
+	paths := []string{}
+	stale := make(map[string]bool)
+	for dst, e := range p.state.Created {
+		if p.created.Has(dst) {
+			continue
+		}
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			log.Debugf("Forgetting '%s', it does not exist anymore", dst)
+			continue
+		}
+		if p.expanded[e.Operation+":"+e.Source] && !p.elements[dst] {
+			// element of a foreach gone from the data
+			if e.Modified(dst) {
+				log.Warnf("Not deleting '%s', it was modified since confinit created it", dst)
+				pending[dst] = e
+				continue
+			}
+			stale[dst] = true
+			paths = append(paths, dst)
+			continue
+		}
+		// the sources of downloads are urls
+		_, errs := os.Lstat(e.Source)
+		if ((errs == nil || config.ValidUrl(e.Source)) && p.operations[e.Operation]) || p.Config.Prune == "off" {
+			// not processed in this run (condition, excludes ...)
+			pending[dst] = e
+			continue
+		}
+		if e.Modified(dst) {
+			log.Warnf("Not pruning '%s', it was modified since confinit created it", dst)
+			continue
+		}
+		paths = append(paths, dst)
+	}
+	// Reverse order: files before the folders which contain them
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	failed := false
+	for _, dst := range paths {
+		e := p.state.Created[dst]
+		prune := p.Config.Prune
+		if stale[dst] {
+			prune = "delete"
+		}
+		switch prune {
+		case "delete":
+			if err := os.Remove(dst); err != nil {
+				if e.IsDir {
+					log.Infof("Not pruning folder '%s', %s", dst, err)
+					continue
+				}
+				log.Errorf("Cannot prune '%s', %s", dst, err)
+				pending[dst] = e
+				failed = true
+				continue
+			}
+			if stale[dst] {
+				log.Infof("Deleted '%s', its foreach element of '%s' is gone", dst, e.Source)
+				continue
+			}
+			log.Infof("Pruned '%s', source '%s' does not exist", dst, e.Source)
+		default:
+			log.Infof("Prune candidate '%s', source '%s' does not exist", dst, e.Source)
+			pending[dst] = e
+		}
+	}
+	p.carry(pending)
+	p.saveState()
+	if failed {
+		return fmt.Errorf("Not all files could be pruned!")
+	}
+	return nil
+}
+
+// carry keeps entries from previous runs in the state of this run
+func (p *Program) carry(entries map[string]*state.Entry) {
+	for dst, e := range entries {
+		if !p.created.Has(dst) {
+			p.created.Created[dst] = e
+		}
+	}
+}
+
+func (p *Program) saveState() {
+	log := p.Configurator.Logger()
+	if err := p.created.Save(); err != nil {
+		log.Errorf("Cannot save state to '%s': %s", p.created.Path(), err)
+		return
+	}
+	log.Debugf("State saved to '%s'", p.created.Path())
+}
@@ -0,0 +1,64 @@
+package program
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"confinit/internal/config"
+)
+
+func TestPruneKeepsDownloadsOfSkippedProcesses(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("downloaded\n"))
+	}))
+	defer srv.Close()
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	if err = os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProgram(t, src)
+	p.Config.StateFile = filepath.Join(tmp, "state.json")
+	p.Config.Prune = "delete"
+	p.Config.Process[0].Downloads = []*config.Download{{URL: srv.URL + "/app.conf", DestinationPath: dst + "/"}}
+	if err = p.Config.SetDefaultConfig(); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dst, "app.conf")
+	run := func(when string) {
+		p.Config.Process[0].When = when
+		p.LoadState()
+		rc, err := p.Process()
+		if err != nil {
+			t.Fatalf("Process returned %d, %v", rc, err)
+		}
+		if err = p.Prune(rc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run("")
+	if _, err = os.Stat(file); err != nil {
+		t.Fatalf("File not downloaded: %s", err)
+	}
+	run("false")
+	if _, err = os.Stat(file); err != nil {
+		t.Errorf("Download of a skipped process pruned: %s", err)
+	}
+	if !p.created.Has(file) {
+		t.Errorf("Download of a skipped process not tracked")
+	}
+	// removed from the configuration
+	p.Config.Process[0].Downloads = nil
+	run("")
+	if _, err = os.Stat(file); err == nil {
+		t.Errorf("Download removed from the configuration not pruned")
+	}
+}
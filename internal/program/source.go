@@ -0,0 +1,116 @@
+package program
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"confinit/internal/config"
+	"confinit/pkg/archive"
+	"confinit/pkg/fs/actions"
+	"confinit/pkg/state"
+)
+
+// cacheDir is the folder where archive (and url) sources are unpacked,
+// next to the state file to keep the same paths between runs
+func (p *Program) cacheDir() string {
+	if p.Config.StateFile == "" {
+		return filepath.Join(os.TempDir(), "confinit", "sources")
+	}
+	return filepath.Join(filepath.Dir(p.Config.StateFile), "sources")
+}
+
+// layers returns the list of folders to scan for a process, paths are
+// rendered as templates. Origins maps the folders where archives are
+// unpacked to the archive (or url).
+func (p *Program) layers(proc *config.Process) (layers []string, origins map[string]string, err error) {
+	origins = make(map[string]string)
+	sources := proc.Sources
+	if proc.Source != "" {
+		sources = append([]string{proc.Source}, sources...)
+	}
+	for i, src := range sources {
+		if src, err = p.render("layer", src); err != nil {
+			err = fmt.Errorf("Cannot render source '%s', %s", sources[i], err)
+			return
+		}
+		checksum := ""
+		if i == 0 && proc.Source != "" {
+			checksum = proc.Checksum
+		}
+		dir, origin, errs := p.source(src, checksum)
+		if errs != nil {
+			return nil, nil, errs
+		}
+		if origin != "" {
+			origins[dir] = origin
+		}
+		layers = append(layers, dir)
+	}
+	return
+}
+
+// source returns the folder to scan for a source. Archives (local or
+// from an url) are unpacked in a folder, origin is the archive or url.
+func (p *Program) source(src, checksum string) (dir, origin string, err error) {
+	isurl := config.ValidUrl(src)
+	if !isurl && !archive.IsArchive(src) {
+		return src, "", nil
+	}
+	log := p.Configurator.Logger()
+	origin = src
+	dir = filepath.Join(p.cacheDir(), fmt.Sprintf("%x", sha1.Sum([]byte(src))))
+	file := src
+	if isurl {
+		u, _ := url.Parse(src)
+		file = dir + "." + archive.Format(u.Path)
+		d, errd := actions.NewDownloader(file, true, 60, 3)
+		if errd != nil {
+			return "", origin, errd
+		}
+		_, cache, errd := d.Download(src, checksum, p.state.Downloads[file])
+		if cache != nil {
+			p.created.Downloads[file] = cache
+		}
+		if errd != nil {
+			return "", origin, errd
+		}
+	} else if checksum != "" {
+		sum, errs := actions.ParseChecksum(checksum)
+		if errs != nil {
+			return "", origin, errs
+		}
+		if ok, errs := sum.File(file); errs != nil {
+			return "", origin, errs
+		} else if !ok {
+			return "", origin, fmt.Errorf("Checksum mismatch for '%s', expected %s", file, sum)
+		}
+	}
+	key := file + ":" + dir
+	sum, err := state.Checksum(file)
+	if err != nil {
+		return "", origin, err
+	}
+	if _, errStat := os.Stat(dir); errStat == nil && p.state.Archives[key] == sum {
+		log.Infof("Reusing source '%s' unpacked in %s, archive not changed since last run", origin, dir)
+		p.created.Archives[key] = sum
+		return dir, origin, nil
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return "", origin, err
+	}
+	if err = os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return "", origin, err
+	}
+	x, _ := archive.NewExtractor(0, nil, nil)
+	if err = x.Extract(file, dir); err != nil {
+		// a partial unpack cannot be reused
+		os.RemoveAll(dir)
+		return "", origin, err
+	}
+	p.created.Archives[key] = sum
+	log.Infof("Source '%s' unpacked in %s", origin, dir)
+	return dir, origin, nil
+}
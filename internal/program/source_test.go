@@ -0,0 +1,93 @@
+package program
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeArchive creates a tar archive with one file
+func writeArchive(t *testing.T, p string) {
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	content := []byte("conf\n")
+	if err = tw.WriteHeader(&tar.Header{Name: "conf", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSourceArchiveReused(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "source.tar")
+	writeArchive(t, src)
+	p := newTestProgram(t, src)
+	p.Config.StateFile = filepath.Join(tmp, "state.json")
+	p.LoadState()
+	dir, _, err := p.source(src, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	marker := filepath.Join(dir, "marker")
+	if err = ioutil.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.created.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// next run, the archive did not change
+	p.LoadState()
+	if _, _, err = p.source(src, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(marker); err != nil {
+		t.Errorf("Source unpacked again with the same archive")
+	}
+	if err = p.created.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// the archive changed, padding is ignored by tar
+	f, _ := os.OpenFile(src, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write(make([]byte, 1024))
+	f.Close()
+	p.LoadState()
+	if _, _, err = p.source(src, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(marker); err == nil {
+		t.Errorf("Source not unpacked again with a new archive")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "conf")); err != nil {
+		t.Errorf("Source not unpacked: %s", err)
+	}
+}
+
+func TestSourceInvalidChecksum(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "source.tar")
+	writeArchive(t, src)
+	p := newTestProgram(t, src)
+	p.LoadState()
+	if _, _, err = p.source(src, "sha256:invalid"); err == nil {
+		t.Errorf("Invalid checksum accepted")
+	}
+}
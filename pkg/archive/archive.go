@@ -0,0 +1,459 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	fs "confinit/pkg/fs"
+	log "confinit/pkg/log"
+)
+
+const (
+	FormatNone  = ""
+	FormatTar   = "tar"
+	FormatTarGz = "tar.gz"
+	FormatTarXz = "tar.xz"
+	FormatZip   = "zip"
+)
+
+// Format returns the type of archive by the extension of the file
+func Format(p string) string {
+	name := strings.ToLower(filepath.Base(p))
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return FormatTar
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return FormatTarGz
+	case strings.HasSuffix(name, ".tar.xz"), strings.HasSuffix(name, ".txz"):
+		return FormatTarXz
+	case strings.HasSuffix(name, ".zip"):
+		return FormatZip
+	}
+	return FormatNone
+}
+
+// IsArchive returns true if the file is a supported archive
+func IsArchive(p string) bool {
+	return Format(p) != FormatNone
+}
+
+// Entry is an item inside an archive
+type Entry struct {
+	Name     string
+	Mode     os.FileMode
+	Uid      int
+	Gid      int
+	Uname    string
+	Gname    string
+	Linkname string
+	Hardlink bool
+}
+
+// Extractor unpacks archives into a destination folder. Callback (if
+// defined) is called for each item extracted.
+type Extractor struct {
+	StripComponents int
+	Include         []*fs.Glob
+	Exclude         []*fs.Glob
+	Owners          map[string]string
+	Groups          map[string]string
+	SameOwner       bool
+	DirMode         os.FileMode
+	FileMode        os.FileMode
+	Callback        func(dst string, existed bool) error
+}
+
+func NewExtractor(strip int, include, exclude []string) (*Extractor, error) {
+	x := Extractor{
+		StripComponents: strip,
+		Owners:          make(map[string]string),
+		Groups:          make(map[string]string),
+	}
+	for _, g := range include {
+		pattern, err := fs.NewGlob(g)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid include glob pattern '%s', %s", g, err)
+		}
+		x.Include = append(x.Include, pattern)
+	}
+	for _, g := range exclude {
+		pattern, err := fs.NewGlob(g)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid exclude glob pattern '%s', %s", g, err)
+		}
+		x.Exclude = append(x.Exclude, pattern)
+	}
+	return &x, nil
+}
+
+// Extract unpacks the archive src into the folder dst
+func (x *Extractor) Extract(src, dst string) error {
+	switch Format(src) {
+	case FormatTar, FormatTarGz, FormatTarXz:
+		return x.extractTar(src, dst)
+	case FormatZip:
+		return x.extractZip(src, dst)
+	}
+	return fmt.Errorf("Archive format of '%s' not supported", src)
+}
+
+// target returns the destination of the entry name, empty if the
+// entry has to be skipped
+func (x *Extractor) target(dst, name string) (string, error) {
+	name = filepath.ToSlash(name)
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	if len(parts) <= x.StripComponents {
+		return "", nil
+	}
+	for _, p := range parts {
+		if p == ".." {
+			return "", fmt.Errorf("Invalid path in archive '%s', path traversal", name)
+		}
+	}
+	rel := filepath.Join(parts[x.StripComponents:]...)
+	if rel == "." || rel == "" {
+		return "", nil
+	}
+	if len(x.Include) > 0 {
+		match := false
+		for _, g := range x.Include {
+			if g.MatchString(rel) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			log.Debugf("Skipping '%s' from archive, not included", rel)
+			return "", nil
+		}
+	}
+	for _, g := range x.Exclude {
+		if g.MatchString(rel) {
+			log.Debugf("Skipping '%s' from archive due to glob '%s'", rel, g)
+			return "", nil
+		}
+	}
+	full := filepath.Join(dst, rel)
+	if !within(dst, full) {
+		return "", fmt.Errorf("Invalid path in archive '%s', outside of destination", name)
+	}
+	return full, nil
+}
+
+// within returns true if p is inside of the folder base
+func within(base, p string) bool {
+	rel, err := filepath.Rel(base, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolve returns p with the links of its existing part resolved, the
+// part which does not exist yet is appended as it is
+func resolve(p string) (string, error) {
+	missing := []string{}
+	current := filepath.Clean(p)
+	for {
+		r, err := filepath.EvalSymlinks(current)
+		if err == nil {
+			return filepath.Join(append([]string{r}, missing...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if fi, errl := os.Lstat(current); errl == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("'%s' is a broken link", current)
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return p, nil
+		}
+		missing = append([]string{filepath.Base(current)}, missing...)
+		current = parent
+	}
+}
+
+// contained checks that p, once the links of its existing part are
+// resolved, is inside of dst (also resolved). Links in the archive or
+// already in the destination can point outside of it.
+func contained(dst, p, name string) (string, error) {
+	root, err := resolve(dst)
+	if err != nil {
+		return "", fmt.Errorf("Cannot resolve destination '%s', %s", dst, err)
+	}
+	resolved, err := resolve(p)
+	if err != nil {
+		return "", fmt.Errorf("Invalid path in archive '%s', %s", name, err)
+	}
+	if !within(root, resolved) {
+		return "", fmt.Errorf("Invalid path in archive '%s', outside of destination through a link", name)
+	}
+	return resolved, nil
+}
+
+func (x *Extractor) extractTar(src, dst string) (err error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch Format(src) {
+	case FormatTarGz:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("Cannot read '%s', %s", src, err)
+		}
+		defer gz.Close()
+		r = gz
+	case FormatTarXz:
+		// There is no xz decompressor in the standard library
+		var stderr bytes.Buffer
+		cmd := exec.Command("xz", "--decompress", "--stdout")
+		cmd.Stdin = f
+		cmd.Stderr = &stderr
+		out, errp := cmd.StdoutPipe()
+		if errp != nil {
+			return errp
+		}
+		if errp = cmd.Start(); errp != nil {
+			return fmt.Errorf("Cannot run xz to read '%s', %s", src, errp)
+		}
+		defer func() {
+			if err != nil {
+				// xz can be blocked writing
+				cmd.Process.Kill()
+			} else {
+				io.Copy(ioutil.Discard, out)
+			}
+			// a corrupt or truncated archive is only reported here
+			if errw := cmd.Wait(); errw != nil && err == nil {
+				err = fmt.Errorf("Cannot read '%s', xz %s: %s", src, errw, strings.TrimSpace(stderr.String()))
+			}
+		}()
+		r = out
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot read '%s', %s", src, err)
+		}
+		e := Entry{
+			Name:     h.Name,
+			Mode:     h.FileInfo().Mode(),
+			Uid:      h.Uid,
+			Gid:      h.Gid,
+			Uname:    h.Uname,
+			Gname:    h.Gname,
+			Linkname: h.Linkname,
+			Hardlink: h.Typeflag == tar.TypeLink,
+		}
+		switch h.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+			if err := x.entry(dst, &e, tr); err != nil {
+				return err
+			}
+		default:
+			log.Debugf("Skipping '%s' from archive, unsupported type", h.Name)
+		}
+	}
+	return nil
+}
+
+func (x *Extractor) extractZip(src, dst string) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return fmt.Errorf("Cannot read '%s', %s", src, err)
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		e := Entry{
+			Name: zf.Name,
+			Mode: zf.Mode(),
+			Uid:  -1,
+			Gid:  -1,
+		}
+		if e.Mode&os.ModeSymlink != 0 {
+			log.Debugf("Skipping '%s' from archive, symlinks in zip are not supported", zf.Name)
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("Cannot read '%s' from '%s', %s", zf.Name, src, err)
+		}
+		err = x.entry(dst, &e, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *Extractor) entry(dst string, e *Entry, r io.Reader) error {
+	target, err := x.target(dst, e.Name)
+	if err != nil || target == "" {
+		return err
+	}
+	// the folder of the entry cannot go outside of dst through links
+	parent, err := contained(dst, filepath.Dir(target), e.Name)
+	if err != nil {
+		return err
+	}
+	fi, errStat := os.Lstat(target)
+	existed := errStat == nil
+	dirmode := os.FileMode(0755)
+	if x.DirMode != 0 {
+		dirmode = x.DirMode
+	}
+	if err := os.MkdirAll(filepath.Dir(target), dirmode); err != nil {
+		return err
+	}
+	switch {
+	case e.Mode.IsDir():
+		if existed && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Invalid path in archive '%s', '%s' is a link", e.Name, target)
+		}
+		mode := e.Mode.Perm()
+		if x.DirMode != 0 {
+			mode = x.DirMode
+		}
+		if err := os.MkdirAll(target, mode); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	case e.Mode&os.ModeSymlink != 0:
+		root, err := resolve(dst)
+		if err != nil {
+			return err
+		}
+		link := filepath.Join(parent, e.Linkname)
+		if filepath.IsAbs(e.Linkname) || !within(root, link) {
+			return fmt.Errorf("Invalid link in archive '%s' -> '%s', outside of destination", e.Name, e.Linkname)
+		}
+		os.Remove(target)
+		if err := os.Symlink(e.Linkname, target); err != nil {
+			return err
+		}
+	case e.Hardlink:
+		link, err := x.target(dst, e.Linkname)
+		if err != nil {
+			return err
+		}
+		if link == "" {
+			return fmt.Errorf("Invalid link in archive '%s' -> '%s', target not extracted", e.Name, e.Linkname)
+		}
+		if _, err = contained(dst, link, e.Linkname); err != nil {
+			return err
+		}
+		os.Remove(target)
+		if err := os.Link(link, target); err != nil {
+			return err
+		}
+	default:
+		if err := x.file(target, e, r); err != nil {
+			return err
+		}
+	}
+	if err := x.chown(target, e); err != nil {
+		return err
+	}
+	log.Debugf("Extracted '%s' to '%s'", e.Name, target)
+	if x.Callback != nil {
+		return x.Callback(target, existed)
+	}
+	return nil
+}
+
+func (x *Extractor) file(target string, e *Entry, r io.Reader) error {
+	mode := e.Mode.Perm()
+	if x.FileMode != 0 {
+		mode = x.FileMode
+	}
+	// Do not write through existing links
+	if fi, err := os.Lstat(target); err == nil && !fi.Mode().IsRegular() {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(target, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, mode)
+	if err != nil {
+		return fmt.Errorf("Cannot create file %s, %s", target, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("Cannot extract to '%s': %s", target, err)
+	}
+	return f.Chmod(mode)
+}
+
+// chown applies the ownership mappings (or the owner of the entry if
+// SameOwner is enabled)
+func (x *Extractor) chown(target string, e *Entry) error {
+	uid, err := x.owner(x.Owners, e.Uname, e.Uid, fs.LookupUser)
+	if err != nil {
+		return fmt.Errorf("Cannot map owner of '%s', %s", e.Name, err)
+	}
+	gid, err := x.owner(x.Groups, e.Gname, e.Gid, fs.LookupGroup)
+	if err != nil {
+		return fmt.Errorf("Cannot map group of '%s', %s", e.Name, err)
+	}
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+	if err = os.Lchown(target, uid, gid); err != nil {
+		return fmt.Errorf("Cannot set owner (%d) and/or group (%d) to '%s': %s", uid, gid, target, err)
+	}
+	return nil
+}
+
+// owner returns the local id of an archive user/group looking for its
+// name and its id in the mappings, -1 means unchanged
+func (x *Extractor) owner(m map[string]string, name string, id int, lookup func(string) (int, error)) (int, error) {
+	if v, ok := m[name]; ok && name != "" {
+		return lookup(v)
+	}
+	if v, ok := m[strconv.Itoa(id)]; ok && id >= 0 {
+		return lookup(v)
+	}
+	if x.SameOwner && id >= 0 {
+		if name != "" {
+			if n, err := lookup(name); err == nil {
+				return n, nil
+			}
+		}
+		return id, nil
+	}
+	return -1, nil
+}
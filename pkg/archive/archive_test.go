@@ -0,0 +1,154 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+}
+
+// writeTar creates the tar archive p with the entries
+func writeTar(t *testing.T, p string, entries []tarEntry) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		h := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+		}
+		if e.typeflag == tar.TypeDir {
+			h.Mode = 0755
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	tmp, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmp
+}
+
+func TestExtractSymlinkChainOutside(t *testing.T) {
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+	dst := filepath.Join(tmp, "dst", "inner")
+	src := filepath.Join(tmp, "evil.tar")
+	writeTar(t, src, []tarEntry{
+		{name: "a", typeflag: tar.TypeSymlink, linkname: "."},
+		{name: "a/b", typeflag: tar.TypeSymlink, linkname: ".."},
+		{name: "a/b/escaped", typeflag: tar.TypeReg, content: "x"},
+	})
+	x, _ := NewExtractor(0, nil, nil)
+	if err := x.Extract(src, dst); err == nil {
+		t.Errorf("Extracting through a chain of links did not fail")
+	}
+	if _, err := os.Lstat(filepath.Join(tmp, "dst", "escaped")); err == nil {
+		t.Errorf("File extracted outside of the destination")
+	}
+}
+
+func TestExtractThroughExistingLink(t *testing.T) {
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+	dst, outside := filepath.Join(tmp, "dst"), filepath.Join(tmp, "outside")
+	for _, d := range []string{dst, outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(dst, "link")); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(tmp, "evil.tar")
+	writeTar(t, src, []tarEntry{
+		{name: "link/escaped", typeflag: tar.TypeReg, content: "x"},
+	})
+	x, _ := NewExtractor(0, nil, nil)
+	if err := x.Extract(src, dst); err == nil {
+		t.Errorf("Extracting through an existing link did not fail")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "escaped")); err == nil {
+		t.Errorf("File extracted outside of the destination")
+	}
+}
+
+func TestExtractLinksInside(t *testing.T) {
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+	dst := filepath.Join(tmp, "dst")
+	src := filepath.Join(tmp, "ok.tar")
+	writeTar(t, src, []tarEntry{
+		{name: "lib64/", typeflag: tar.TypeDir},
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: "lib64"},
+		{name: "lib/file", typeflag: tar.TypeReg, content: "x"},
+	})
+	x, _ := NewExtractor(0, nil, nil)
+	if err := x.Extract(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "lib64", "file")); err != nil {
+		t.Errorf("File not extracted through a link inside of the destination: %s", err)
+	}
+}
+
+func TestExtractCorruptXz(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not available")
+	}
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+	tarfile := filepath.Join(tmp, "a.tar")
+	entries := []tarEntry{}
+	for _, n := range []string{"a", "b", "c"} {
+		entries = append(entries, tarEntry{name: n, typeflag: tar.TypeReg, content: n})
+	}
+	writeTar(t, tarfile, entries)
+	if out, err := exec.Command("xz", "--keep", tarfile).CombinedOutput(); err != nil {
+		t.Fatalf("xz: %s %s", err, out)
+	}
+	content, err := ioutil.ReadFile(tarfile + ".xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// corrupt the integrity check at the end of the stream
+	content[len(content)-20] ^= 0xff
+	src := filepath.Join(tmp, "corrupt.tar.xz")
+	if err = ioutil.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	x, _ := NewExtractor(0, nil, nil)
+	if err = x.Extract(src, filepath.Join(tmp, "dst")); err == nil {
+		t.Errorf("Corrupt xz archive extracted without errors")
+	}
+	x, _ = NewExtractor(0, nil, nil)
+	if err = x.Extract(tarfile+".xz", filepath.Join(tmp, "dst2")); err != nil {
+		t.Errorf("Valid xz archive not extracted: %s", err)
+	}
+}
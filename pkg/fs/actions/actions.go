@@ -17,8 +17,12 @@ package actions
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 
+	archive "confinit/pkg/archive"
+	fs "confinit/pkg/fs"
 	log "confinit/pkg/log"
 )
 
@@ -64,10 +68,31 @@ func (d *DeleteType) Names(sep string) (result string) {
 	return
 }
 
+// Output is a destination written by the router
+type Output struct {
+	Source  string
+	Existed bool
+}
+
 type ActionRouter struct {
 	*Runner
 	Condition string
 	Delete    DeleteType
+	Outputs   map[string]*Output
+	Extractor *Extractor
+	RunParts  bool
+	Workers   int
+	// Incremental skips the copies of the items not changed since the previous run
+	Incremental bool
+	// Foreach is an expression with the elements to render each file
+	Foreach string
+	// Expanded are the sources rendered per element of Foreach and
+	// Elements the destinations computed for them, written or not
+	Expanded map[string]bool
+	Elements map[string]bool
+	// frontMatters are read by Sequential and used by Function
+	frontMatters map[*fs.Item]*FrontMatter
+	mutex        sync.Mutex
 }
 
 func NewActionRouter(glob, dst string, force, skipext, render bool, excludes []string) (*ActionRouter, error) {
@@ -76,12 +101,105 @@ func NewActionRouter(glob, dst string, force, skipext, render bool, excludes []s
 		return nil, err
 	}
 	a := ActionRouter{
-		Runner: r,
-		Delete: DeleteNever,
+		Runner:   r,
+		Delete:   DeleteNever,
+		Outputs:  make(map[string]*Output),
+		Expanded: make(map[string]bool),
+		Elements: make(map[string]bool),
+
+		frontMatters: make(map[*fs.Item]*FrontMatter),
 	}
 	return &a, nil
 }
 
+// SetExtractor makes the router unpack archives instead of copying them
+func (a *ActionRouter) SetExtractor(x *archive.Extractor) {
+	a.Extractor = NewExtractor(a.Replicator, x, a.Outputs, &a.mutex)
+}
+
+// SetRunParts makes the router skip the files which run-parts would
+// not execute
+func (a *ActionRouter) SetRunParts(enabled bool) {
+	a.RunParts = enabled
+}
+
+// SetIncremental makes the router skip the copies of the files which did
+// not change since the previous run if their destination is still there,
+// templates are rendered and commands executed again
+func (a *ActionRouter) SetIncremental(enabled bool) {
+	a.Incremental = enabled
+}
+
+// SetForeach defines an expression which evaluates to a list or a map,
+// the files are rendered once per element
+func (a *ActionRouter) SetForeach(expr string) {
+	a.Foreach = expr
+}
+
+func (a *ActionRouter) Match(item *fs.Item) bool {
+	if !a.Processor.Match(item) {
+		return false
+	}
+	if a.RunParts && !item.Mode.IsDir() && !fs.RunParts(filepath.Join(item.Base, item.Path), item.Mode) {
+		log.Debugf("Skipping file not valid for run-parts: %s", item.Path)
+		return false
+	}
+	return true
+}
+
+// SetParallel defines how many files are processed at the same time,
+// 0 is the default of the Fs. Commands are executed one by one
+// unless maxcmds is greater than 1.
+func (a *ActionRouter) SetParallel(workers, maxcmds int) {
+	a.Workers = workers
+	a.SetMaxCommands(maxcmds)
+}
+
+// MaxParallel implements fs.Parallel interface
+func (a *ActionRouter) MaxParallel() int {
+	if a.Cmd != "" {
+		if a.MaxCommands > 1 {
+			return a.MaxCommands
+		}
+		return 1
+	}
+	return a.Workers
+}
+
+// Sequential implements fs.Sequential interface, files with their own
+// command (in a folder configuration or front matter) run alone and in
+// order, unless more commands are allowed at the same time
+func (a *ActionRouter) Sequential(item *fs.Item) bool {
+	if a.MaxCommands > 1 || item.Mode.IsDir() {
+		return false
+	}
+	if item.Config != nil && len(item.Config.Operation.Command) > 0 {
+		return true
+	}
+	// errors are reported when the file is processed
+	fm, err := readFrontMatter(item)
+	if err != nil {
+		return false
+	}
+	a.mutex.Lock()
+	a.frontMatters[item] = fm
+	a.mutex.Unlock()
+	return fm != nil && len(fm.Command) > 0
+}
+
+// frontMatter returns the front matter of the item, read only once if
+// Sequential already did it
+func (a *ActionRouter) frontMatter(item *fs.Item) (*FrontMatter, error) {
+	a.mutex.Lock()
+	fm, ok := a.frontMatters[item]
+	delete(a.frontMatters, item)
+	a.mutex.Unlock()
+	if ok {
+		return fm, nil
+	}
+	return readFrontMatter(item)
+}
+
 func (a *ActionRouter) SetCondition(c string) {
 	a.Condition = c
 }
@@ -90,93 +208,241 @@ func (a *ActionRouter) SetDelete(delete DeleteType) {
 	a.Delete.Set(delete)
 }
 
-func (a *ActionRouter) condition(data *TemplateData) (bool, string, error) {
-	if a.Condition != "" {
-		c, err := a.renderTemplateString("condition", a.Condition, data)
-		if err != nil {
-			return false, "", fmt.Errorf("Cannot render condition '%s', %s", a.Condition, err)
+// ListOutputs returns the destinations written by the router
+func (a *ActionRouter) ListOutputs() map[string]*Output {
+	return a.Outputs
+}
+
+// ListExpanded returns the sources rendered per element of the foreach
+// and the destinations computed for all their elements
+func (a *ActionRouter) ListExpanded() (map[string]bool, map[string]bool) {
+	return a.Expanded, a.Elements
+}
+
+func (a *ActionRouter) addOutput(dst, src string, existed bool) {
+	if _, err := os.Lstat(dst); err == nil {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		a.Outputs[dst] = &Output{
+			Source:  src,
+			Existed: existed,
+		}
+	}
+}
+
+// settings returns the render flag and the command for the item, taken
+// from the operation, folder configuration and front matter (in order)
+func (a *ActionRouter) settings(item *fs.Item, data *TemplateData) (bool, string) {
+	render, cmd := a.Render, a.Cmd
+	if item.Config != nil {
+		if item.Config.Operation.Template != nil {
+			render = *item.Config.Operation.Template
+		}
+		if len(item.Config.Operation.Command) > 0 {
+			cmd = strings.Join(item.Config.Operation.Command, " ")
+		}
+	}
+	if data.FrontMatter != nil && len(data.FrontMatter.Command) > 0 {
+		cmd = strings.Join(data.FrontMatter.Command, " ")
+	}
+	return render, cmd
+}
+
+// output returns the destination of the item without rendering it
+func (a *ActionRouter) output(item *fs.Item, data *TemplateData, render bool, cmd string) string {
+	fm := data.FrontMatter
+	skipext := item.Config != nil && item.Config.Operation.DelExtension != nil
+	if !render && cmd == "" && !skipext && !data.templated && (fm == nil || (fm.Destination == "" && fm.DelExtension == nil)) {
+		// Replicator does not remove extensions
+		return filepath.Join(a.DstPath, item.Path)
+	}
+	return data.Destination
+}
+
+// condition renders the condition for the file and returns its outcome,
+// each file gets its own one (starting with the operation delete actions)
+func (a *ActionRouter) condition(data *TemplateData) (*Outcome, error) {
+	condition := a.Condition
+	if data.item.Config != nil && data.item.Config.Operation.Condition != nil {
+		condition = *data.item.Config.Operation.Condition
+	}
+	if data.FrontMatter != nil && data.FrontMatter.Condition != nil {
+		condition = *data.FrontMatter.Condition
+	}
+	if condition == "" {
+		return NewOutcome(a.Delete), nil
+	}
+	c, err := a.renderTemplateString("condition", condition, data)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot render condition '%s', %s", condition, err)
+	}
+	o, err := ParseOutcome(c, a.Delete)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot use condition of %s, %s", data.SourceOrigin, err)
+	}
+	return o, nil
+}
+
+func (a *ActionRouter) Function(item *fs.Item) error {
+	fm, err := a.frontMatter(item)
+	if err != nil {
+		return err
+	}
+	tpldata, err := a.newTemplateData(item, fm)
+	if err != nil {
+		return err
+	}
+	if render, cmd := a.settings(item, tpldata); !render && cmd == "" && !tpldata.extset {
+		// Replicator does not remove extensions
+		tpldata.skipext = false
+	}
+	if a.Foreach != "" && !item.Mode.IsDir() {
+		return a.foreach(item, tpldata)
+	}
+	if err = a.destination(tpldata); err != nil {
+		return err
+	}
+	return a.process(item, tpldata)
+}
+
+// foreach processes the file once per element of the foreach expression
+func (a *ActionRouter) foreach(item *fs.Item, tpldata *TemplateData) error {
+	value, err := a.evaluate(a.Foreach, tpldata)
+	if err != nil {
+		return fmt.Errorf("Cannot evaluate foreach '%s' for %s, %s", a.Foreach, tpldata.SourceOrigin, err)
+	}
+	list, err := elements(value)
+	if err != nil {
+		return fmt.Errorf("Cannot use foreach '%s' for %s, %s", a.Foreach, tpldata.SourceOrigin, err)
+	}
+	a.mutex.Lock()
+	a.Expanded[tpldata.SourceFullPath] = true
+	a.mutex.Unlock()
+	keys := make(map[string]interface{})
+	for _, e := range list {
+		data := *tpldata
+		data.Key, data.Item = e.Key, e.Item
+		if err = a.destination(&data); err != nil {
+			return err
 		}
-		c = strings.TrimSpace(c)
-		if !a.Delete.Has(DeleteIfCondition) {
-			if c != "" {
-				return false, c, nil
+		if data.skip == "" {
+			render, cmd := a.settings(item, &data)
+			output := a.output(item, &data, render, cmd)
+			if k, ok := keys[output]; ok {
+				return fmt.Errorf("Elements '%v' and '%v' of %s have the same destination '%s'", k, e.Key, tpldata.SourceOrigin, output)
 			}
-			return true, "render", nil
+			keys[output] = e.Key
+			a.mutex.Lock()
+			a.Elements[output] = true
+			a.mutex.Unlock()
 		}
-		switch output := strings.ToLower(c); output {
-		case "":
-			// continue
-			return true, "render", nil
-		case "continue":
-			// continue
-			return true, "render", nil
-		case "render":
-			// continue
-			return true, c, nil
-		case "skip":
-			// no render
-			return false, c, nil
-		case "delete":
-			// no render
-			a.Delete.Set(DeletePreStart)
-			return false, c, nil
-		case "delete-file":
-			// no render
-			a.Delete.Set(DeletePreStart)
-			return false, "delete", nil
-		case "delete-if-empty":
-			a.Delete.Set(DeleteIfEmpty)
-			return true, c, nil
-		case "delete-if-fail":
-			a.Delete.Set(DeleteIfRenderFail)
-			return true, c, nil
-		case "delete-after-exec":
-			a.Delete.Set(DeleteAfterExec)
-			return true, c, nil
+		if err = a.process(item, &data); err != nil {
+			return err
 		}
-		// no render, show message
-		return false, c, nil
 	}
-	return true, "render", nil
+	return nil
 }
 
-func (a *ActionRouter) Function(base string, path string, i os.FileMode) (err error) {
-	tpldata := a.NewTemplateData(base, path, i)
+// process renders, copies or executes the item with the data
+func (a *ActionRouter) process(item *fs.Item, tpldata *TemplateData) (err error) {
+	if tpldata.skip != "" {
+		log.Infof("Skipping %s, %s", tpldata.SourceOrigin, tpldata.skip)
+		return nil
+	}
 	action := ""
-	c, msg, errc := a.condition(tpldata)
-	if errc != nil {
-		return errc
-	} else if !c {
-		log.Infof("Skipping render %s, condition reported: %s", tpldata.SourceFullPath, msg)
+	outcome, err := a.condition(tpldata)
+	if err != nil {
+		return err
+	}
+	if err = a.apply(outcome, tpldata); err != nil {
+		return err
+	}
+	del := outcome.Delete
+	render, cmd := a.settings(item, tpldata)
+	output := a.output(item, tpldata, render, cmd)
+	switch outcome.Action {
+	case ActionSkip:
+		log.Infof("Skipping render %s, condition reported: %s", tpldata.SourceOrigin, outcome.Reason())
+		return nil
+	case ActionDelete:
+		if a.DstPath != "" && !item.Mode.IsDir() {
+			if _, errout := os.Lstat(output); errout == nil {
+				if err = os.Remove(output); err != nil {
+					return
+				}
+				log.Infof("Condition delete triggered for %s, deleted", output)
+			}
+		}
+		log.Infof("Skipping render %s, condition reported: %s", tpldata.SourceOrigin, outcome.Reason())
+		return nil
+	}
+	if outcome.Message != "" {
+		log.Infof("Condition of %s reported: %s", tpldata.SourceOrigin, outcome.Message)
+	}
+	if a.Foreach != "" && !item.Mode.IsDir() {
+		// the condition can change the destination of the element
+		a.mutex.Lock()
+		a.Elements[output] = true
+		a.mutex.Unlock()
+	}
+	_, errout := os.Lstat(output)
+	existed := !os.IsNotExist(errout)
+	// only copies, templates and commands depend on data and settings
+	// not tracked by the scan index
+	if a.Incremental && !item.Changed && a.Extractor == nil && !render && cmd == "" && existed {
+		log.Debugf("Skipping %s, not changed since the previous run", tpldata.SourceOrigin)
+		// keep tracking it, otherwise it would be pruned
+		a.addOutput(output, tpldata.SourceFullPath, existed)
 		return nil
 	}
+	binary := false
+	if render && a.DstPath != "" && a.Extractor == nil {
+		switch b, errb := a.binary(tpldata); {
+		case errb != nil:
+			return errb
+		case b == BinarySkip:
+			return nil
+		case b == BinaryCopy:
+			render, binary = false, true
+			output = a.output(item, tpldata, render, cmd)
+		}
+	}
 	if a.DstPath != "" {
-		if _, err = os.Stat(tpldata.Destination); !os.IsNotExist(err) {
-			if a.Delete.Has(DeletePreStart) && !i.IsDir() {
-				if err = os.Remove(tpldata.Destination); err != nil {
+		if _, err = os.Stat(output); !os.IsNotExist(err) {
+			if del.Has(DeletePreStart) && !item.Mode.IsDir() {
+				if err = os.Remove(output); err != nil {
 					return
 				}
 			}
 		}
 	}
-	if a.Cmd != "" {
-		action, err = a.Runner.Function(base, path, i)
-		if a.DstPath != "" && a.Delete.Has(DeleteAfterExec) {
+	if cmd != "" {
+		if binary {
+			// in place of the rendered template
+			if _, err = a.replicate(item, output, tpldata.FrontMatter); err != nil {
+				return
+			}
+		}
+		action, err = a.run(tpldata, cmd, render)
+		if a.DstPath != "" && del.Has(DeleteAfterExec) {
 			os.Remove(tpldata.Destination)
 			log.Infof("Condition delete-after-exec triggered for %s, deleted", tpldata.Destination)
 		}
 	} else {
 		if a.DstPath != "" {
-			if a.Render {
-				action, err = a.Templator.Function(base, path, i)
-				if err != nil && a.Delete.Has(DeleteIfRenderFail) {
+			if a.Extractor != nil {
+				_, err = a.Extractor.Function(item)
+				return
+			} else if render {
+				action, err = a.render(tpldata)
+				if err != nil && del.Has(DeleteIfRenderFail) {
 					os.Remove(action)
 					log.Infof("Condition delete-if-error triggered for %s, deleted", action)
 				}
 			} else {
-				action, err = a.Replicator.Function(base, path, i)
+				action, err = a.replicate(item, output, tpldata.FrontMatter)
 			}
-			if err == nil && a.Delete.Has(DeleteIfEmpty) {
+			if err == nil && del.Has(DeleteIfEmpty) {
 				if fi, err := os.Stat(action); err == nil {
 					size := fi.Size()
 					if size <= 0 {
@@ -187,5 +453,8 @@ func (a *ActionRouter) Function(base string, path string, i os.FileMode) (err er
 			}
 		}
 	}
+	if err == nil && a.DstPath != "" {
+		a.addOutput(output, tpldata.SourceFullPath, existed)
+	}
 	return
 }
@@ -0,0 +1,208 @@
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fs "confinit/pkg/fs"
+)
+
+// recorder is an Execute which keeps the commands run
+type recorder struct {
+	command []string
+	mutex   *sync.Mutex
+	run     *[]string
+}
+
+func (r *recorder) Command(command []string)     { r.command = command }
+func (r *recorder) SetEnv(env map[string]string) {}
+func (r *recorder) SetTimeout(t int)             {}
+func (r *recorder) SetDir(d string)              {}
+func (r *recorder) String() string               { return "" }
+
+func (r *recorder) Run() (int, error) {
+	r.mutex.Lock()
+	*r.run = append(*r.run, strings.Join(r.command, " "))
+	r.mutex.Unlock()
+	time.Sleep(time.Millisecond)
+	return 0, nil
+}
+
+// generateTree writes n files with content in folders of 100 files
+func generateTree(tb testing.TB, n int, content func(i int) string) string {
+	src, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(src, fmt.Sprintf("d%03d", i/100))
+		if i%100 == 0 {
+			if err = os.MkdirAll(dir, 0755); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		name := filepath.Join(dir, fmt.Sprintf("f%05d.conf", i))
+		if err = ioutil.WriteFile(name, []byte(content(i)), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return src
+}
+
+func scanTree(tb testing.TB, src string, workers int) *fs.Fs {
+	f := fs.New(fs.Workers(workers))
+	if err := f.ScanLayers([]string{src}); err != nil {
+		tb.Fatal(err)
+	}
+	return f
+}
+
+func newTestRouter(tb testing.TB, dst string) *ActionRouter {
+	a, err := NewActionRouter(".*", dst, true, false, true, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return a
+}
+
+func TestFrontMatterCommandsRunInOrder(t *testing.T) {
+	src := generateTree(t, 40, func(i int) string {
+		if i%2 == 0 {
+			return fmt.Sprintf("---\ncommand: [\"run\", \"%d\"]\n---\n{{ .Source }}\n", i)
+		}
+		return "{{ .Source }}\n"
+	})
+	defer os.RemoveAll(src)
+	dst, _ := ioutil.TempDir("", "confinit")
+	defer os.RemoveAll(dst)
+	var mutex sync.Mutex
+	run := []string{}
+	a := newTestRouter(t, dst)
+	a.SetRunner(&recorder{mutex: &mutex, run: &run}, map[string]string{}, 0, "")
+	a.SetExecFactory(func() Execute {
+		return &recorder{mutex: &mutex, run: &run}
+	})
+	a.SetParallel(8, 0)
+	if err := scanTree(t, src, 8).Run(a); err != nil {
+		t.Fatal(err)
+	}
+	if len(run) != 20 {
+		t.Fatalf("Expected 20 commands, got %d", len(run))
+	}
+	for i, cmd := range run {
+		if expected := fmt.Sprintf("run %d", i*2); cmd != expected {
+			t.Fatalf("Commands not run in order, got %v", run)
+		}
+	}
+	outputs := []string{}
+	for output := range a.ListOutputs() {
+		outputs = append(outputs, output)
+	}
+	sort.Strings(outputs)
+	if len(outputs) != 40 {
+		t.Errorf("Expected 40 files rendered, got %d", len(outputs))
+	}
+}
+
+func TestFrontMatterReadOnce(t *testing.T) {
+	src := generateTree(t, 1, func(i int) string {
+		return "---\ndata:\n  v: one\n---\n{{ .Data.v }}\n"
+	})
+	defer os.RemoveAll(src)
+	dst, _ := ioutil.TempDir("", "confinit")
+	defer os.RemoveAll(dst)
+	item := &fs.Item{Base: src, Path: filepath.Join("d000", "f00000.conf"), Mode: 0644, Changed: true}
+	a := newTestRouter(t, dst)
+	if a.Sequential(item) {
+		t.Fatalf("File without command is sequential")
+	}
+	// the front matter read by Sequential is used to process the file
+	content := "---\ndata:\n  v: two\n---\n{{ .Data.v }}\n"
+	if err := ioutil.WriteFile(filepath.Join(src, item.Path), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Function(item); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := ioutil.ReadFile(filepath.Join(dst, item.Path)); string(out) != "one\n" {
+		t.Errorf("Front matter read again, rendered %q", out)
+	}
+	if len(a.frontMatters) != 0 {
+		t.Errorf("Front matters not released: %v", a.frontMatters)
+	}
+}
+
+// latency simulates a slow filesystem (network or cloud storage), the
+// workers only help when the files wait for I/O, rendering files of a
+// local disk is bound by the CPUs
+type latency struct {
+	*ActionRouter
+}
+
+func (l latency) Function(item *fs.Item) error {
+	time.Sleep(time.Millisecond)
+	return l.ActionRouter.Function(item)
+}
+
+func benchmarkRunTree(b *testing.B, n, workers int, slow bool, content func(i int) string) {
+	src := generateTree(b, n, content)
+	defer os.RemoveAll(src)
+	f := scanTree(b, src, workers)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dst, _ := ioutil.TempDir("", "confinit")
+		var a fs.Process = newTestRouter(b, dst)
+		if slow {
+			a = latency{a.(*ActionRouter)}
+		}
+		b.StartTimer()
+		if err := f.Run(a); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		os.RemoveAll(dst)
+		b.StartTimer()
+	}
+}
+
+func plainTemplate(i int) string {
+	return "{{ .Source }} {{ .SourceFile }}\n"
+}
+
+// frontMatterTemplate has a front matter, without commands the files
+// are not sequential
+func frontMatterTemplate(i int) string {
+	return "---\nmode: \"0640\"\n---\n{{ .Source }} {{ .SourceFile }}\n"
+}
+
+func BenchmarkRunTree10kWorkers1(b *testing.B) {
+	benchmarkRunTree(b, 10000, 1, false, plainTemplate)
+}
+
+func BenchmarkRunTree10kWorkers8(b *testing.B) {
+	benchmarkRunTree(b, 10000, 8, false, plainTemplate)
+}
+
+func BenchmarkRunTree10kFrontMatterWorkers1(b *testing.B) {
+	benchmarkRunTree(b, 10000, 1, false, frontMatterTemplate)
+}
+
+func BenchmarkRunTree10kFrontMatterWorkers8(b *testing.B) {
+	benchmarkRunTree(b, 10000, 8, false, frontMatterTemplate)
+}
+
+func BenchmarkRunTree1kLatencyWorkers1(b *testing.B) {
+	benchmarkRunTree(b, 1000, 1, true, plainTemplate)
+}
+
+func BenchmarkRunTree1kLatencyWorkers8(b *testing.B) {
+	benchmarkRunTree(b, 1000, 8, true, plainTemplate)
+}
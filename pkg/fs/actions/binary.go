@@ -0,0 +1,81 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package actions
+
+import (
+	"fmt"
+
+	fs "confinit/pkg/fs"
+	log "confinit/pkg/log"
+)
+
+// What to do with binary files matched by a template operation
+const (
+	BinaryCopy = "copy"
+	BinarySkip = "skip"
+	BinaryFail = "fail"
+)
+
+// SetBinary defines what to do with the binary files instead of
+// rendering them: copy (verbatim), skip or fail
+func (ft *Templator) SetBinary(policy string) error {
+	switch policy {
+	case BinaryCopy, BinarySkip, BinaryFail:
+		ft.Binary = policy
+		return nil
+	}
+	return fmt.Errorf("Invalid binary policy '%s'", policy)
+}
+
+// ListBinaries returns the binary files found (origin) and what was
+// done with them
+func (ft *Templator) ListBinaries() map[string]string {
+	return ft.Binaries
+}
+
+// binary returns the binary policy if the template of data is a binary
+// file or "" if it can be rendered. The decision is logged and recorded.
+// Copied files keep their extension, unless the folder configuration or
+// front matter say otherwise.
+func (ft *Templator) binary(data *TemplateData) (string, error) {
+	if data.IsDir {
+		return "", nil
+	}
+	ok, err := fs.IsBinary(data.SourceFullPath)
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return "", nil
+	}
+	ft.bmutex.Lock()
+	ft.Binaries[data.SourceOrigin] = ft.Binary
+	ft.bmutex.Unlock()
+	switch ft.Binary {
+	case BinarySkip:
+		log.Warnf("Skipping render %s, binary file", data.SourceOrigin)
+	case BinaryFail:
+		return ft.Binary, fmt.Errorf("Binary file %s cannot be rendered as a template", data.SourceOrigin)
+	default:
+		if data.skipext && !data.extset {
+			// copied like the other files, keeping the extension
+			data.skipext = false
+			if err = ft.destination(data); err != nil {
+				return ft.Binary, err
+			}
+		}
+		log.Infof("Binary file %s, copied verbatim to %s", data.SourceOrigin, data.Destination)
+	}
+	return ft.Binary, nil
+}
@@ -0,0 +1,164 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package actions
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	fs "confinit/pkg/fs"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ActionRender = "render"
+	ActionSkip   = "skip"
+	ActionDelete = "delete"
+)
+
+// Outcome is what the condition decided for one file. The condition
+// can render a YAML (or JSON) block with these fields or one keyword.
+type Outcome struct {
+	Action      string                 `yaml:"action"`
+	Mode        string                 `yaml:"mode"`
+	Owner       string                 `yaml:"owner"`
+	Group       string                 `yaml:"group"`
+	Destination string                 `yaml:"destination"`
+	Message     string                 `yaml:"message"`
+	Data        map[string]interface{} `yaml:"data"`
+	// Delete are the delete actions of the operation plus the ones
+	// requested by the condition
+	Delete DeleteType `yaml:"-"`
+}
+
+// NewOutcome returns the default outcome, render with the delete
+// actions del
+func NewOutcome(del DeleteType) *Outcome {
+	return &Outcome{
+		Action: ActionRender,
+		Delete: del,
+	}
+}
+
+// ParseOutcome parses the output of a condition, del are the delete
+// actions of the operation. Without DeleteIfCondition the condition
+// cannot request deletes, keywords skip the file and deletes in
+// directives are skips. Empty blocks (like null or {}) are not
+// directives, they skip the file like any other output.
+func ParseOutcome(output string, del DeleteType) (*Outcome, error) {
+	o := NewOutcome(del)
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return o, nil
+	}
+	allowed := del.Has(DeleteIfCondition)
+	decoded := Outcome{}
+	if err := yaml.UnmarshalStrict([]byte(output), &decoded); err != nil || reflect.DeepEqual(decoded, Outcome{}) {
+		// not a directive, keyword or message
+		if !allowed {
+			o.Action, o.Message = ActionSkip, output
+			return o, nil
+		}
+		if !o.setAction(output, true) {
+			o.Action, o.Message = ActionSkip, output
+		}
+		return o, nil
+	}
+	o = &decoded
+	o.Delete = del
+	if o.Action == "" {
+		o.Action = ActionRender
+	}
+	if !o.setAction(o.Action, allowed) {
+		return nil, fmt.Errorf("Invalid action '%s'", o.Action)
+	}
+	if _, err := fs.ParseMode(o.Mode); err != nil {
+		return nil, fmt.Errorf("Invalid mode '%s', %s", o.Mode, err)
+	}
+	return o, nil
+}
+
+// setAction sets the action from a keyword, returns false if the
+// keyword is not valid. Delete actions are skips if deletes is false.
+func (o *Outcome) setAction(keyword string, deletes bool) bool {
+	flags := map[string]DeleteType{
+		"delete-if-empty":   DeleteIfEmpty,
+		"delete-if-fail":    DeleteIfRenderFail,
+		"delete-after-exec": DeleteAfterExec,
+	}
+	switch k := strings.ToLower(strings.TrimSpace(keyword)); k {
+	case "continue", ActionRender:
+		o.Action = ActionRender
+	case ActionSkip:
+		o.Action = ActionSkip
+	case ActionDelete, "delete-file":
+		o.Action = ActionDelete
+		if !deletes {
+			o.Action = ActionSkip
+		}
+	default:
+		flag, ok := flags[k]
+		if !ok {
+			return false
+		}
+		o.Action = ActionRender
+		if deletes {
+			o.Delete.Set(flag)
+		}
+	}
+	return true
+}
+
+// Reason describes the outcome in the logs
+func (o *Outcome) Reason() string {
+	if o.Message != "" {
+		return o.Message
+	}
+	return o.Action
+}
+
+// apply sets the data, destination, mode and owners of the outcome
+// in data, they win over the front matter settings
+func (a *ActionRouter) apply(o *Outcome, data *TemplateData) (err error) {
+	if len(o.Data) > 0 {
+		if data.Data, err = mergeData(data.Data, o.Data); err != nil {
+			return fmt.Errorf("Cannot add data from condition of '%s': %s", data.SourceOrigin, err)
+		}
+	}
+	if o.Mode == "" && o.Owner == "" && o.Group == "" && o.Destination == "" {
+		return nil
+	}
+	fm := FrontMatter{}
+	if data.FrontMatter != nil {
+		fm = *data.FrontMatter
+	}
+	if o.Mode != "" {
+		fm.Mode = o.Mode
+	}
+	if o.Owner != "" {
+		fm.Owner = o.Owner
+	}
+	if o.Group != "" {
+		fm.Group = o.Group
+	}
+	data.FrontMatter = &fm
+	if o.Destination != "" {
+		fm.Destination = o.Destination
+		return a.destination(data)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package actions
+
+import (
+	"testing"
+)
+
+func TestParseOutcome(t *testing.T) {
+	del := DeleteNever
+	del.Set(DeleteIfCondition)
+	tests := []struct {
+		output string
+		action string
+		mode   string
+		err    bool
+	}{
+		{"", ActionRender, "", false},
+		{"continue", ActionRender, "", false},
+		{"delete", ActionDelete, "", false},
+		{"not configured", ActionSkip, "", false},
+		{"null", ActionSkip, "", false},
+		{"~", ActionSkip, "", false},
+		{"{}", ActionSkip, "", false},
+		{"mode: \"0600\"", ActionRender, "0600", false},
+		{"mode: u+x,go-w", ActionRender, "u+x,go-w", false},
+		{"action: skip\nmode: \"0640\"", ActionSkip, "0640", false},
+		{"mode: \"0999\"", "", "", true},
+		{"mode: u+q", "", "", true},
+		{"action: unknown", "", "", true},
+	}
+	for _, test := range tests {
+		o, err := ParseOutcome(test.output, del)
+		if test.err {
+			if err == nil {
+				t.Errorf("Condition %q accepted: %+v", test.output, o)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Condition %q failed: %s", test.output, err)
+			continue
+		}
+		if o.Action != test.action || o.Mode != test.mode {
+			t.Errorf("Condition %q got action %q and mode %q, expected %q and %q", test.output, o.Action, o.Mode, test.action, test.mode)
+		}
+		if !o.Delete.Has(DeleteIfCondition) {
+			t.Errorf("Condition %q lost the delete actions of the operation", test.output)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package actions
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	fs "confinit/pkg/fs"
+	log "confinit/pkg/log"
+	state "confinit/pkg/state"
+)
+
+const downloadUserAgent = "confinit"
+
+// Checksum is an expected hash of a file in the form "sha256:<hex>"
+type Checksum struct {
+	Algorithm string
+	Sum       string
+}
+
+// ParseChecksum parses "sha256:<hex>", "sha512:<hex>" or just the hex
+// string (the algorithm is guessed by its length)
+func ParseChecksum(s string) (*Checksum, error) {
+	if s == "" {
+		return nil, nil
+	}
+	c := Checksum{}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 2 {
+		c.Algorithm = strings.ToLower(parts[0])
+		c.Sum = strings.ToLower(parts[1])
+	} else {
+		c.Sum = strings.ToLower(parts[0])
+		switch len(c.Sum) {
+		case sha256.Size * 2:
+			c.Algorithm = "sha256"
+		case sha512.Size * 2:
+			c.Algorithm = "sha512"
+		}
+	}
+	if _, err := hex.DecodeString(c.Sum); err != nil {
+		return nil, fmt.Errorf("Invalid checksum '%s', %s", s, err)
+	}
+	switch c.Algorithm {
+	case "sha256":
+		if len(c.Sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("Invalid sha256 checksum length '%s'", s)
+		}
+	case "sha512":
+		if len(c.Sum) != sha512.Size*2 {
+			return nil, fmt.Errorf("Invalid sha512 checksum length '%s'", s)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported checksum '%s', only sha256 and sha512", s)
+	}
+	return &c, nil
+}
+
+// Hash returns a new hash for the algorithm
+func (c *Checksum) Hash() hash.Hash {
+	if c.Algorithm == "sha512" {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// Compute returns the hex hash of the file content with the algorithm
+func (c *Checksum) Compute(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := c.Hash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// File checks if the file content matches the checksum
+func (c *Checksum) File(p string) (bool, error) {
+	sum, err := c.Compute(p)
+	return err == nil && sum == c.Sum, err
+}
+
+func (c *Checksum) String() string {
+	return c.Algorithm + ":" + c.Sum
+}
+
+// Downloader gets files from HTTP(S) urls and applies permissions to them
+type Downloader struct {
+	*Replicator
+	Client  *http.Client
+	Retries int
+	Backoff time.Duration
+}
+
+func NewDownloader(dst string, force bool, timeout, retries int) (*Downloader, error) {
+	rpc, err := NewReplicator(".*", dst, fs.FsItemFile, force, nil)
+	if err != nil {
+		return nil, err
+	}
+	d := Downloader{
+		Replicator: rpc,
+		Client: &http.Client{
+			Timeout: time.Duration(timeout) * time.Second,
+		},
+		Retries: retries,
+		Backoff: time.Second,
+	}
+	return &d, nil
+}
+
+// Destination returns the file where url will be downloaded, if the
+// destination is a folder the name is taken from the url
+func (fd *Downloader) Destination(url string) string {
+	dst := fd.DstPath
+	if fi, err := os.Stat(dst); (err == nil && fi.IsDir()) || strings.HasSuffix(dst, "/") {
+		name := path.Base(strings.SplitN(url, "?", 2)[0])
+		dst = filepath.Join(dst, name)
+	}
+	return dst
+}
+
+func (fd *Downloader) request(url string, cache *state.Download) (res *http.Response, err error) {
+	wait := fd.Backoff
+	for attempt := 0; attempt <= fd.Retries; attempt++ {
+		if attempt > 0 {
+			log.Warnf("Download of '%s' failed (%s), retrying in %s", url, err, wait)
+			time.Sleep(wait)
+			wait = wait * 2
+		}
+		req, errReq := http.NewRequest(http.MethodGet, url, nil)
+		if errReq != nil {
+			return nil, errReq
+		}
+		req.Header.Set("User-Agent", downloadUserAgent)
+		if cache != nil {
+			if cache.ETag != "" {
+				req.Header.Set("If-None-Match", cache.ETag)
+			}
+			if cache.LastModified != "" {
+				req.Header.Set("If-Modified-Since", cache.LastModified)
+			}
+		}
+		res, err = fd.Client.Do(req)
+		if err != nil {
+			continue
+		}
+		switch {
+		case res.StatusCode == http.StatusOK || res.StatusCode == http.StatusNotModified:
+			return res, nil
+		case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+			res.Body.Close()
+			err = fmt.Errorf("HTTP status code %s", res.Status)
+		default:
+			res.Body.Close()
+			return nil, fmt.Errorf("HTTP status code %s", res.Status)
+		}
+	}
+	return nil, err
+}
+
+func (fd *Downloader) write(body io.Reader, dst string, sum *Checksum) (string, error) {
+	if err := fd.mkdir(filepath.Dir(dst), os.FileMode(0755)); err != nil {
+		return "", err
+	}
+	filemode := os.FileMode(0644)
+	if fd.FileMode != 0 {
+		filemode = fd.FileMode
+	}
+	tmp := dst + ".download"
+	f, err := os.OpenFile(tmp, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, filemode)
+	if err != nil {
+		return "", fmt.Errorf("Cannot create file %s, %s", tmp, err)
+	}
+	defer os.Remove(tmp)
+	h256 := sha256.New()
+	writers := []io.Writer{f, h256}
+	var h hash.Hash
+	if sum != nil {
+		h = sum.Hash()
+		writers = append(writers, h)
+	}
+	bytes, err := io.Copy(io.MultiWriter(writers...), body)
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("Cannot download to '%s': %s", dst, err)
+	}
+	if sum != nil {
+		if got := hex.EncodeToString(h.Sum(nil)); got != sum.Sum {
+			return "", fmt.Errorf("Checksum mismatch for '%s', expected %s, got %s:%s", dst, sum, sum.Algorithm, got)
+		}
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		return "", err
+	}
+	log.Debugf("Successfully downloaded '%s': %d bytes", dst, bytes)
+	return hex.EncodeToString(h256.Sum(nil)), nil
+}
+
+// validators returns the HTTP validators to download url again only if
+// it was modified. The cache is used when the local file is the one which
+// was downloaded, without force an existing file is only replaced if the
+// server has a newer one.
+func (fd *Downloader) validators(url, dst string, fi os.FileInfo, cache *state.Download) *state.Download {
+	if cache != nil && cache.URL == url {
+		local := &Checksum{Algorithm: "sha256", Sum: cache.Checksum}
+		if ok, _ := local.File(dst); ok {
+			return cache
+		}
+	}
+	if fd.Force {
+		return nil
+	}
+	c := &state.Download{
+		URL:          url,
+		LastModified: fi.ModTime().UTC().Format(http.TimeFormat),
+	}
+	local := &Checksum{Algorithm: "sha256"}
+	c.Checksum, _ = local.Compute(dst)
+	return c
+}
+
+// Download gets url into the destination verifying its checksum. An
+// existing file which does not match the checksum is always downloaded
+// again, otherwise it is requested with the validators of the cache (or
+// its modification time) and kept if the server reports it was not
+// modified. It returns the new validators.
+func (fd *Downloader) Download(url, checksum string, cache *state.Download) (dst string, c *state.Download, err error) {
+	dst = fd.Destination(url)
+	sum, err := ParseChecksum(checksum)
+	if err != nil {
+		return
+	}
+	var validators *state.Download
+	if fi, errStat := os.Stat(dst); errStat == nil && !fi.IsDir() {
+		valid := true
+		if sum != nil {
+			if valid, err = sum.File(dst); err != nil {
+				err = fmt.Errorf("Cannot check '%s', %s", dst, err)
+				return
+			} else if !valid {
+				log.Warnf("File %s does not match the checksum %s, downloading it again", dst, sum)
+			}
+		}
+		if valid {
+			validators = fd.validators(url, dst, fi, cache)
+		}
+	}
+	res, err := fd.request(url, validators)
+	if err != nil {
+		err = fmt.Errorf("Cannot download '%s', %s", url, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified && validators != nil {
+		log.Debugf("Skipped download of '%s', not modified", url)
+		c = validators
+	} else if res.StatusCode == http.StatusNotModified {
+		err = fmt.Errorf("Cannot download '%s', unexpected HTTP status code %s", url, res.Status)
+		return
+	} else {
+		c = &state.Download{
+			URL:          url,
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+		}
+		if c.Checksum, err = fd.write(res.Body, dst, sum); err != nil {
+			return
+		}
+		log.Infof("Downloaded '%s' to '%s'", url, dst)
+	}
+	err = fd.applyPermissions(dst)
+	return
+}
@@ -0,0 +1,157 @@
+package actions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const downloadContent = "confinit download\n"
+
+var downloadChecksum = func() string {
+	sum := sha256.Sum256([]byte(downloadContent))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}()
+
+// downloadServer fails the first requests with 503 and answers 304 to
+// conditional requests with the ETag
+func downloadServer(failures int32, requests *int32, conditional *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(requests, 1)
+		if n <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			atomic.AddInt32(conditional, 1)
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(downloadContent))
+	}))
+}
+
+func newTestDownloader(t *testing.T, dst string, force bool) *Downloader {
+	d, err := NewDownloader(dst, force, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Backoff = time.Millisecond
+	return d
+}
+
+func TestDownloadRetries(t *testing.T) {
+	var requests, conditional int32
+	srv := downloadServer(2, &requests, &conditional)
+	defer srv.Close()
+	tmp, _ := ioutil.TempDir("", "confinit")
+	defer os.RemoveAll(tmp)
+	dst := filepath.Join(tmp, "file")
+	d := newTestDownloader(t, dst, true)
+	_, c, err := d.Download(srv.URL+"/file", downloadChecksum, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests)
+	}
+	if c == nil || c.ETag != `"v1"` {
+		t.Errorf("Validators not returned: %+v", c)
+	}
+	if content, _ := ioutil.ReadFile(dst); string(content) != downloadContent {
+		t.Errorf("Unexpected content '%s'", content)
+	}
+	// no more retries left
+	requests = 0
+	srv3 := downloadServer(3, &requests, &conditional)
+	defer srv3.Close()
+	if _, _, err = d.Download(srv3.URL+"/file", "", nil); err == nil {
+		t.Errorf("Download did not fail after the retries")
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	var requests, conditional int32
+	srv := downloadServer(0, &requests, &conditional)
+	defer srv.Close()
+	tmp, _ := ioutil.TempDir("", "confinit")
+	defer os.RemoveAll(tmp)
+	dst := filepath.Join(tmp, "file")
+	d := newTestDownloader(t, dst, false)
+	wrong := "sha256:" + hex.EncodeToString(make([]byte, sha256.Size))
+	if _, _, err := d.Download(srv.URL+"/file", wrong, nil); err == nil {
+		t.Errorf("Download with a wrong checksum did not fail")
+	}
+	if _, err := os.Stat(dst); err == nil {
+		t.Errorf("File with a wrong checksum was kept")
+	}
+	// a local file which does not match is downloaded again even
+	// without force and with valid validators
+	ioutil.WriteFile(dst, []byte("modified"), 0644)
+	_, c, err := d.Download(srv.URL+"/file", downloadChecksum, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(dst, []byte("modified"), 0644)
+	if _, _, err = d.Download(srv.URL+"/file", downloadChecksum, c); err != nil {
+		t.Fatal(err)
+	}
+	if conditional != 0 {
+		t.Errorf("Conditional request for a file which does not match the checksum")
+	}
+	if content, _ := ioutil.ReadFile(dst); string(content) != downloadContent {
+		t.Errorf("File not downloaded again, content '%s'", content)
+	}
+}
+
+func TestDownloadNotModified(t *testing.T) {
+	var requests, conditional int32
+	srv := downloadServer(0, &requests, &conditional)
+	defer srv.Close()
+	tmp, _ := ioutil.TempDir("", "confinit")
+	defer os.RemoveAll(tmp)
+	dst := filepath.Join(tmp, "file")
+	for _, force := range []bool{false, true} {
+		os.Remove(dst)
+		requests, conditional = 0, 0
+		d := newTestDownloader(t, dst, force)
+		_, c, err := d.Download(srv.URL+"/file", downloadChecksum, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modtime := time.Now().Add(-time.Hour)
+		os.Chtimes(dst, modtime, modtime)
+		_, c2, err := d.Download(srv.URL+"/file", downloadChecksum, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if requests != 2 || conditional != 1 {
+			t.Errorf("Force %v, expected a conditional request, got %d requests, %d conditional", force, requests, conditional)
+		}
+		if c2 == nil || c2.ETag != c.ETag || c2.Checksum != c.Checksum {
+			t.Errorf("Validators not kept after 304: %+v", c2)
+		}
+		if fi, _ := os.Stat(dst); fi == nil || fi.ModTime().After(modtime.Add(time.Minute)) {
+			t.Errorf("File written after 304")
+		}
+	}
+	// without force an existing file is requested by its modification time
+	requests, conditional = 0, 0
+	d := newTestDownloader(t, dst, false)
+	if _, _, err := d.Download(srv.URL+"/file", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if conditional != 1 {
+		t.Errorf("Existing file without validators not requested with If-Modified-Since")
+	}
+}
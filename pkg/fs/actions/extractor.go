@@ -0,0 +1,109 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package actions
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	archive "confinit/pkg/archive"
+	fs "confinit/pkg/fs"
+	log "confinit/pkg/log"
+	state "confinit/pkg/state"
+)
+
+// Extractor unpacks the matched archives in the destination folder,
+// keeping the relative folder of the archive in the source
+type Extractor struct {
+	*Replicator
+	Archive   *archive.Extractor
+	Outputs   map[string]*Output
+	Checksums map[string]string
+	Extracted map[string]string
+	// mutex protects Outputs (shared) and Extracted
+	mutex *sync.Mutex
+}
+
+func NewExtractor(rpc *Replicator, x *archive.Extractor, outputs map[string]*Output, mutex *sync.Mutex) *Extractor {
+	e := Extractor{
+		Replicator: rpc,
+		Archive:    x,
+		Outputs:    outputs,
+		Checksums:  make(map[string]string),
+		Extracted:  make(map[string]string),
+		mutex:      mutex,
+	}
+	return &e
+}
+
+// SetChecksums defines the checksums of the archives extracted in
+// the previous run
+func (fx *Extractor) SetChecksums(sums map[string]string) {
+	if sums != nil {
+		fx.Checksums = sums
+	}
+}
+
+func (fx *Extractor) extracted(key, sum string) {
+	fx.mutex.Lock()
+	defer fx.mutex.Unlock()
+	fx.Extracted[key] = sum
+}
+
+func (fx *Extractor) Function(item *fs.Item) (dst string, err error) {
+	src := filepath.Join(item.Base, item.Path)
+	dst = filepath.Join(fx.DstPath, filepath.Dir(item.Path))
+	if item.Mode.IsDir() {
+		return
+	}
+	if !archive.IsArchive(src) {
+		err = fmt.Errorf("Format of archive '%s' not supported", src)
+		return
+	}
+	key := src + ":" + dst
+	sum, err := state.Checksum(src)
+	if err != nil {
+		return
+	}
+	if _, errStat := os.Stat(dst); errStat == nil && fx.Checksums[key] == sum {
+		log.Infof("Skipping extraction of '%s', archive not changed since last run", src)
+		fx.extracted(key, sum)
+		return
+	}
+	if err = fx.mkdir(dst, os.FileMode(0755)); err != nil {
+		return
+	}
+	// Copy, archives can be extracted at the same time
+	x := *fx.Archive
+	x.DirMode = fx.DirMode
+	x.FileMode = fx.FileMode
+	x.Callback = func(p string, existed bool) error {
+		fx.mutex.Lock()
+		fx.Outputs[p] = &Output{
+			Source:  src,
+			Existed: existed,
+		}
+		fx.mutex.Unlock()
+		return fx.applyPermissions(p)
+	}
+	if err = x.Extract(src, dst); err != nil {
+		return
+	}
+	fx.extracted(key, sum)
+	log.Infof("Successfully extracted '%s' to '%s'", src, dst)
+	return
+}
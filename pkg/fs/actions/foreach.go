@@ -0,0 +1,97 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// element is a key and its value in the list or map of a foreach
+type element struct {
+	Key  interface{}
+	Item interface{}
+}
+
+// evaluate returns the value of the foreach expression for data. An
+// expression with a single action, like '{{ .Data.networking }}', returns
+// the value of the pipeline, otherwise the expression is rendered and
+// parsed as yaml.
+func (ft *Templator) evaluate(expr string, data *TemplateData) (interface{}, error) {
+	var value interface{}
+	var render bytes.Buffer
+	text := strings.TrimSpace(expr)
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "{{"), "}}")
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "-"), "-")
+	if strings.HasPrefix(strings.TrimSpace(expr), "{{") && !strings.Contains(text, "{{") && !strings.Contains(text, "}}") {
+		// the closure is different for each call, the template
+		// cannot be cached
+		funcs := template.FuncMap{
+			"foreachValue": func(v interface{}) string {
+				value = v
+				return ""
+			},
+		}
+		tpl, err := template.New("foreach").Funcs(ft.funcs).Funcs(funcs).Parse("{{ foreachValue (" + text + ") }}")
+		if err != nil {
+			return nil, err
+		}
+		if err = tpl.Execute(&render, data); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+	out, err := ft.renderTemplateString("foreach", expr, data)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal([]byte(out), &value); err != nil {
+		return nil, fmt.Errorf("Cannot parse the rendered value as yaml, %s", err)
+	}
+	return value, nil
+}
+
+// elements returns the elements of a list (the keys are the indexes) or
+// a map (sorted by key). Nil has no elements.
+func elements(value interface{}) ([]element, error) {
+	result := []element{}
+	if value == nil {
+		return result, nil
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			result = append(result, element{Key: i, Item: v.Index(i).Interface()})
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, k := range keys {
+			result = append(result, element{Key: k.Interface(), Item: v.MapIndex(k).Interface()})
+		}
+	default:
+		return nil, fmt.Errorf("Value of type %T is not a list or a map", value)
+	}
+	return result, nil
+}
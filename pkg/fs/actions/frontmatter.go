@@ -0,0 +1,117 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package actions
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	fs "confinit/pkg/fs"
+	log "confinit/pkg/log"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	frontMatterDelimiter = "---"
+	frontMatterMaxSize   = 64 * 1024
+)
+
+// FrontMatter are the settings defined at the beginning of a file
+// between two lines "---". They override the operation settings.
+type FrontMatter struct {
+	Destination  string                 `yaml:"destination"`
+	Mode         string                 `yaml:"mode"`
+	Owner        string                 `yaml:"owner"`
+	Group        string                 `yaml:"group"`
+	Condition    *string                `yaml:"condition"`
+	DelExtension *bool                  `yaml:"delextension"`
+	Data         map[string]interface{} `yaml:"data"`
+	Command      []string               `yaml:"command"`
+	// Offset is where the content of the file starts
+	Offset int64 `yaml:"-"`
+}
+
+// ReadFrontMatter returns the front matter of a file or nil if the file
+// does not start with one
+func ReadFrontMatter(p string) (*FrontMatter, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(io.LimitReader(f, frontMatterMaxSize))
+	line, err := r.ReadBytes('\n')
+	if err != nil || string(bytes.TrimRight(line, "\r\n")) != frontMatterDelimiter {
+		return nil, nil
+	}
+	offset := int64(len(line))
+	var block bytes.Buffer
+	for {
+		line, err = r.ReadBytes('\n')
+		offset += int64(len(line))
+		if string(bytes.TrimRight(line, "\r\n")) == frontMatterDelimiter {
+			break
+		}
+		if err != nil {
+			// no end of front matter, it is not a front matter
+			return nil, nil
+		}
+		block.Write(line)
+	}
+	fm := FrontMatter{}
+	if err = yaml.Unmarshal(block.Bytes(), &fm); err != nil {
+		return nil, fmt.Errorf("Invalid front matter in '%s', %s", p, err)
+	}
+	if _, err = fs.ParseMode(fm.Mode); err != nil {
+		return nil, fmt.Errorf("Invalid mode '%s' in front matter of '%s'", fm.Mode, p)
+	}
+	fm.Offset = offset
+	log.Debugf("Front matter found in '%s'", p)
+	return &fm, nil
+}
+
+// modeSpec returns the octal or symbolic mode of the front matter, nil
+// if it is not defined. It was validated when the front matter was read.
+func (fm *FrontMatter) modeSpec() *fs.ModeSpec {
+	if fm == nil {
+		return nil
+	}
+	spec, _ := fs.ParseMode(fm.Mode)
+	return spec
+}
+
+// FileMode returns the mode defined in the front matter applied to def,
+// or def if it is not defined
+func (fm *FrontMatter) FileMode(def os.FileMode) os.FileMode {
+	return fm.modeSpec().Apply(def, false)
+}
+
+// Set applies mode, owner and group of the front matter to p, only
+// the defined ones
+func (fm *FrontMatter) Set(p string) error {
+	if fm == nil {
+		return nil
+	}
+	attrs := fs.Attributes{
+		Mode:  fm.modeSpec(),
+		User:  fm.Owner,
+		Group: fm.Group,
+	}
+	return attrs.Set(p)
+}
@@ -0,0 +1,50 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFrontMatterModes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	modes := map[string]os.FileMode{
+		"0600":      0600,
+		"u+x,g+w":   0764,
+		"a=r,u+w":   0644,
+		"go-r,u=rx": 0500,
+	}
+	for mode, expected := range modes {
+		p := filepath.Join(tmp, "file")
+		content := "---\nmode: \"" + mode + "\"\n---\ncontent\n"
+		if err = ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(p, 0644)
+		fm, err := ReadFrontMatter(p)
+		if err != nil {
+			t.Fatalf("Mode %s: %s", mode, err)
+		}
+		if got := fm.FileMode(0644); got != expected {
+			t.Errorf("Mode %s of 0644 is %s, expected %s", mode, got, expected)
+		}
+		if err = fm.Set(p); err != nil {
+			t.Fatal(err)
+		}
+		if fi, _ := os.Stat(p); fi.Mode().Perm() != expected {
+			t.Errorf("Mode %s set to 0644 is %s, expected %s", mode, fi.Mode().Perm(), expected)
+		}
+	}
+	p := filepath.Join(tmp, "invalid")
+	if err = ioutil.WriteFile(p, []byte("---\nmode: \"u+q\"\n---\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadFrontMatter(p); err == nil {
+		t.Errorf("Invalid mode accepted")
+	}
+}
@@ -18,15 +18,29 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
 	fs "confinit/pkg/fs"
 	log "confinit/pkg/log"
 )
 
+type permission struct {
+	globs     fs.Globs
+	perm      *fs.Perm
+	typ       fs.FsItemType
+	recursive bool
+}
+
 type Permissions struct {
 	*fs.Processor
-	perms   map[string]*fs.Perm
-	DstPath string
+	perms     []*permission
+	DstPath   string
+	PathGlobs bool
+	// applied are the destinations with all the permissions set
+	applied map[string]bool
+	mutex   sync.Mutex
 }
 
 func NewPermissions(glob, dst string, typ fs.FsItemType, excludes []string) (*Permissions, error) {
@@ -36,35 +50,84 @@ func NewPermissions(glob, dst string, typ fs.FsItemType, excludes []string) (*Pe
 	}
 	p := Permissions{
 		Processor: proc,
-		perms:     make(map[string]*fs.Perm),
 		DstPath:   dst,
+		applied:   make(map[string]bool),
 	}
 	return &p, nil
 }
 
-func (fp *Permissions) SetPermissions(glob, uid, gid string, mode os.FileMode) error {
-	if _, err := fs.NewGlob(glob); err != nil {
-		err = fmt.Errorf("Invalid glob pattern '%s' for permissions: %s", glob, err)
-		return err
-	}
-	per, err := fs.NewPerm(uid, gid, mode)
+// SetGlobMode makes the permission globs path aware, they are matched
+// against the destination path and the path relative to the destination
+// folder
+func (fp *Permissions) SetGlobMode(path bool) {
+	fp.PathGlobs = path
+}
+
+// SetPermissions applies per to the destinations of type typ matching
+// the globs. Recursive permissions also apply to the contents of the
+// matching folders and to the existing paths of the destination.
+func (fp *Permissions) SetPermissions(globs []string, per *fs.Perm, typ fs.FsItemType, recursive bool) error {
+	patterns, err := fs.NewGlobs(globs, fp.PathGlobs)
 	if err != nil {
+		err = fmt.Errorf("Invalid glob pattern '%s' for permissions: %s", strings.Join(globs, ","), err)
 		return err
 	}
-	fp.perms[glob] = per
+	fp.perms = append(fp.perms, &permission{
+		globs:     patterns,
+		perm:      per,
+		typ:       typ,
+		recursive: recursive,
+	})
 	return nil
 }
 
+// match returns true if the permission applies to dst
+func (fp *Permissions) match(p *permission, dst string, dir bool) bool {
+	if (p.typ == fs.FsItemFile && dir) || (p.typ == fs.FsItemDir && !dir) {
+		return false
+	}
+	for path := dst; ; path = filepath.Dir(path) {
+		rel := path
+		if fp.DstPath != "" {
+			if r, err := filepath.Rel(fp.DstPath, path); err == nil {
+				rel = r
+			}
+		}
+		if p.globs.MatchString(path) || (fp.PathGlobs && p.globs.MatchString(rel)) {
+			return true
+		}
+		// recursive permissions match the folders containing dst
+		if !p.recursive || rel == "." || strings.HasPrefix(rel, "..") || path == filepath.Dir(path) {
+			return false
+		}
+	}
+}
+
 func (fp *Permissions) applyPermissions(dst string) error {
+	fp.mutex.Lock()
+	fp.applied[dst] = true
+	fp.mutex.Unlock()
+	return fp.apply(dst, false)
+}
+
+// apply sets the permissions matching dst, only the recursive ones
+// if recursive is true
+func (fp *Permissions) apply(dst string, recursive bool) error {
 	e := false
-	for glob, p := range fp.perms {
-		pattern, _ := fs.NewGlob(glob)
-		if pattern.MatchString(dst) {
-			if err := p.Set(dst); err != nil {
+	dir := false
+	if fi, err := os.Stat(dst); err == nil {
+		dir = fi.IsDir()
+	}
+	for _, p := range fp.perms {
+		if recursive && !p.recursive {
+			continue
+		}
+		if fp.match(p, dst, dir) {
+			if err := p.perm.Set(dst); err != nil {
 				e = true
-				log.Errorf("Cannot apply pemissions '%s' to '%s'", glob, dst)
+				log.Errorf("Cannot apply pemissions '%s' to '%s': %s", p.globs, dst, err)
 			} else {
-				log.Debugf("Successfully applied permissions to '%s': %s", dst, p)
+				log.Debugf("Successfully applied permissions to '%s': %s", dst, p.perm)
 			}
 		}
 	}
@@ -74,7 +137,122 @@ func (fp *Permissions) applyPermissions(dst string) error {
 	return nil
 }
 
-func (fp *Permissions) Function(base string, path string, i os.FileMode) (dst string, err error) {
-	dst = filepath.Join(fp.DstPath, path)
+// ApplyRecursive sets the recursive permissions to the paths of the
+// destination without source (the others already have all of them).
+// Only the folders matching the literal prefix of the globs are walked,
+// errors are logged and the walk continues. Links are not followed.
+func (fp *Permissions) ApplyRecursive() error {
+	if fp.DstPath == "" {
+		return nil
+	}
+	e := false
+	for _, root := range fp.roots() {
+		filepath.Walk(root, func(p string, i os.FileInfo, err error) error {
+			if err != nil {
+				if !os.IsNotExist(err) {
+					e = true
+					log.Errorf("Cannot apply recursive permissions to '%s': %s", p, err)
+				}
+				return nil
+			}
+			if i.Mode()&os.ModeSymlink == 0 && !fp.applied[p] {
+				if err := fp.apply(p, true); err != nil {
+					e = true
+				}
+			}
+			return nil
+		})
+	}
+	if e {
+		return fmt.Errorf("Cannot apply all recursive permissions to '%s'", fp.DstPath)
+	}
+	return nil
+}
+
+// roots returns the folders of the destination which can have paths
+// matching the recursive permissions, taken from the literal prefix
+// of their globs (the whole destination if there is none)
+func (fp *Permissions) roots() []string {
+	dst := filepath.Clean(fp.DstPath)
+	candidates := []string{}
+	for _, p := range fp.perms {
+		if !p.recursive {
+			continue
+		}
+		for _, g := range p.globs {
+			prefix := g.Pattern
+			if i := strings.IndexAny(prefix, "*?[{\\"); i >= 0 {
+				prefix = prefix[:strings.LastIndex(prefix[:i], "/")+1]
+			}
+			if prefix == "" {
+				return []string{dst}
+			}
+			candidates = append(candidates, prefix)
+			if fp.PathGlobs && !filepath.IsAbs(prefix) {
+				candidates = append(candidates, filepath.Join(dst, prefix))
+			}
+		}
+	}
+	inside := func(p, dir string) bool {
+		rel, err := filepath.Rel(dir, p)
+		return err == nil && !strings.HasPrefix(rel, "..")
+	}
+	roots := []string{}
+	for _, c := range candidates {
+		c = filepath.Clean(c)
+		if !inside(c, dst) {
+			if !inside(dst, c) {
+				continue
+			}
+			c = dst
+		}
+		roots = append(roots, c)
+	}
+	// without the folders inside others
+	sort.Strings(roots)
+	result := []string{}
+	for _, r := range roots {
+		nested := false
+		for _, parent := range result {
+			nested = nested || inside(r, parent)
+		}
+		if !nested {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// applyConfig sets the attributes defined for the item in the folder
+// configuration files (if any) to dst, and to its folder if it is
+// the folder of the item in the destination
+func (fp *Permissions) applyConfig(item *fs.Item, dst string) error {
+	if item == nil || item.Config == nil {
+		return nil
+	}
+	isdir := item.Mode.IsDir()
+	if dir := filepath.Dir(item.Path); !isdir && dir != "." && filepath.Dir(dst) == filepath.Join(fp.DstPath, dir) {
+		if err := fp.setAttributes(item.Config, dir, filepath.Dir(dst), true); err != nil {
+			return err
+		}
+	}
+	return fp.setAttributes(item.Config, item.Path, dst, isdir)
+}
+
+func (fp *Permissions) setAttributes(c *fs.DirConfig, p, dst string, dir bool) error {
+	attrs := c.Attributes(p, dir)
+	if attrs.Mode == nil && attrs.User == "" && attrs.Group == "" {
+		return nil
+	}
+	if err := attrs.Set(dst); err != nil {
+		log.Errorf("Cannot apply folder settings %v to '%s'", c.Files, dst)
+		return err
+	}
+	log.Debugf("Successfully applied folder settings to '%s': %s", dst, attrs)
+	return nil
+}
+
+func (fp *Permissions) Function(item *fs.Item) (dst string, err error) {
+	dst = filepath.Join(fp.DstPath, item.Path)
 	return dst, fp.applyPermissions(dst)
 }
@@ -0,0 +1,56 @@
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	fs "confinit/pkg/fs"
+)
+
+func TestApplyRecursiveRoots(t *testing.T) {
+	dst, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	files := []string{"app/a.conf", "app/sub/b.conf", "bad/c.conf", "bad/d.conf", "other/e.conf"}
+	for _, name := range files {
+		p := filepath.Join(dst, name)
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fp, err := NewPermissions(".*", dst, fs.FsItemAll, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.SetGlobMode(true)
+	private, _ := fs.NewPerm("", "", 0600)
+	if err = fp.SetPermissions([]string{"app", "app/sub/*"}, private, fs.FsItemFile, true); err != nil {
+		t.Fatal(err)
+	}
+	// the owner does not exist, each file fails
+	unknown, _ := fs.NewPerm("confinit-unknown-user", "", 0)
+	if err = fp.SetPermissions([]string{"bad/*.conf"}, unknown, fs.FsItemFile, true); err != nil {
+		t.Fatal(err)
+	}
+	roots := []string{filepath.Join(dst, "app"), filepath.Join(dst, "bad")}
+	if r := fp.roots(); !reflect.DeepEqual(r, roots) {
+		t.Errorf("Expected roots %v, got %v", roots, r)
+	}
+	if err = fp.ApplyRecursive(); err == nil {
+		t.Errorf("Errors not reported")
+	}
+	expected := map[string]os.FileMode{"app/a.conf": 0600, "app/sub/b.conf": 0600, "other/e.conf": 0644}
+	for name, mode := range expected {
+		if fi, _ := os.Stat(filepath.Join(dst, name)); fi.Mode().Perm() != mode {
+			t.Errorf("Mode of %s is %s, expected %s", name, fi.Mode().Perm(), mode)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package actions
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	fs "confinit/pkg/fs"
+	log "confinit/pkg/log"
+)
+
+type PreserveType uint32
+
+const (
+	PreserveMode PreserveType = 1 << iota
+	PreserveOwner
+	PreserveTimes
+	PreserveXattrs
+)
+
+var preserveNames = map[string]PreserveType{
+	"mode":   PreserveMode,
+	"owner":  PreserveOwner,
+	"times":  PreserveTimes,
+	"xattrs": PreserveXattrs,
+}
+
+func (p PreserveType) Has(flag PreserveType) bool {
+	return p&flag != 0
+}
+
+func (p *PreserveType) Set(flag PreserveType) {
+	*p |= flag
+}
+
+// SetPreserve defines the metadata of the sources to keep in the
+// destinations: mode, owner, times and/or xattrs
+func (fr *Replicator) SetPreserve(names ...string) error {
+	for _, name := range names {
+		flag, ok := preserveNames[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("Invalid preserve setting '%s'", name)
+		}
+		fr.Preserve.Set(flag)
+	}
+	return nil
+}
+
+// preserve applies the metadata of the source item to dst. Owner is set
+// before mode (chown clears setuid bits) and xattrs after both (chown
+// clears capabilities). The mode is not changed if there is a default
+// mode, and times are set with setTimes once everything else is done.
+func (fr *Replicator) preserve(item *fs.Item, src, dst string) error {
+	if fr.Preserve == 0 || item.Stat == nil {
+		return nil
+	}
+	st := item.Stat
+	if fr.Preserve.Has(PreserveOwner) && (st.Uid >= 0 || st.Gid >= 0) {
+		if err := os.Lchown(dst, st.Uid, st.Gid); err != nil {
+			return fmt.Errorf("Cannot preserve owner (%d) and/or group (%d) of '%s': %s", st.Uid, st.Gid, dst, err)
+		}
+	}
+	if fr.Preserve.Has(PreserveMode) {
+		defmode := fr.FileMode
+		if st.Mode.IsDir() {
+			defmode = fr.DirMode
+		}
+		if defmode == 0 {
+			mode := st.Mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+			if err := os.Chmod(dst, mode); err != nil {
+				return fmt.Errorf("Cannot preserve mode (%s) of '%s': %s", mode, dst, err)
+			}
+		}
+	}
+	if fr.Preserve.Has(PreserveXattrs) {
+		attrs, err := fs.Xattrs(src)
+		if err != nil {
+			return err
+		}
+		for name, value := range attrs {
+			if err = fs.SetXattr(dst, name, value); err != nil {
+				return err
+			}
+		}
+	}
+	log.Debugf("Successfully preserved metadata of '%s' in '%s'", src, dst)
+	return nil
+}
+
+// setTimes sets the access and modification times of the source item
+// to dst, if they have to be preserved
+func (fr *Replicator) setTimes(item *fs.Item, dst string) error {
+	if !fr.Preserve.Has(PreserveTimes) || item.Stat == nil {
+		return nil
+	}
+	if err := os.Chtimes(dst, item.Stat.AccessTime, item.Stat.ModTime); err != nil {
+		return fmt.Errorf("Cannot preserve times of '%s': %s", dst, err)
+	}
+	return nil
+}
@@ -19,16 +19,32 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 
 	fs "confinit/pkg/fs"
 	log "confinit/pkg/log"
 )
 
+// Parents are the settings of the folders created on the way to the
+// destinations. Without them, and if Inherit is true, they are taken
+// from the nearest existing folder.
+type Parents struct {
+	Mode    os.FileMode
+	User    string
+	Group   string
+	Inherit bool
+}
+
 type Replicator struct {
 	*Permissions
 	Force    bool
 	DirMode  os.FileMode
 	FileMode os.FileMode
+	Preserve PreserveType
+	Parents  Parents
+	// Created are the folders created in the destination
+	Created map[string]os.FileMode
+	cmutex  sync.Mutex
 }
 
 func NewReplicator(glob, dst string, typ fs.FsItemType, force bool, excludes []string) (*Replicator, error) {
@@ -41,6 +57,7 @@ func NewReplicator(glob, dst string, typ fs.FsItemType, force bool, excludes []s
 		Force:       force,
 		DirMode:     os.FileMode(0),
 		FileMode:    os.FileMode(0),
+		Created:     make(map[string]os.FileMode),
 	}
 	return &r, nil
 }
@@ -50,20 +67,131 @@ func (fr *Replicator) SetDefaultModes(dirmode, filemode os.FileMode) {
 	fr.FileMode = filemode
 }
 
+// SetParents defines the settings of the folders created on the way to
+// the destinations
+func (fr *Replicator) SetParents(mode os.FileMode, user, group string, inherit bool) {
+	fr.Parents = Parents{
+		Mode:    mode,
+		User:    user,
+		Group:   group,
+		Inherit: inherit,
+	}
+}
+
+// ListCreated returns the folders created in the destination
+func (fr *Replicator) ListCreated() map[string]os.FileMode {
+	return fr.Created
+}
+
+// mkdir creates the folder dst (which contains destinations) and its
+// parents with the parents settings
 func (fr *Replicator) mkdir(dst string, mode os.FileMode) error {
+	return fr.makedirs(dst, mode, false)
+}
+
+// mkdirItem creates the folder dst of a source folder with mode, only
+// its parents get the parents settings
+func (fr *Replicator) mkdirItem(dst string, mode os.FileMode) error {
+	return fr.makedirs(dst, mode, true)
+}
+
+func (fr *Replicator) makedirs(dst string, mode os.FileMode, item bool) error {
 	if fr.DirMode != 0 {
 		mode = fr.DirMode
 	}
-	if _, err := os.Stat(dst); os.IsNotExist(err) && fr.Force {
-		if err := os.MkdirAll(dst, mode); err != nil {
+	if _, err := os.Stat(dst); !os.IsNotExist(err) || !fr.Force {
+		return nil
+	}
+	// folders to create from top to bottom and the nearest existing one
+	var dirs []string
+	ancestor := dst
+	for {
+		if _, err := os.Stat(ancestor); !os.IsNotExist(err) {
+			break
+		}
+		dirs = append([]string{ancestor}, dirs...)
+		if parent := filepath.Dir(ancestor); parent != ancestor {
+			ancestor = parent
+		} else {
+			break
+		}
+	}
+	var inherited *fs.Stat
+	if fr.Parents.Inherit {
+		if fi, err := os.Stat(ancestor); err == nil {
+			inherited = fs.NewStat(fi)
+		}
+	}
+	for i, d := range dirs {
+		parent := !item || i < len(dirs)-1
+		m := mode
+		if parent {
+			m = fr.parentMode(mode, inherited)
+		}
+		if err := os.Mkdir(d, m); err != nil {
+			if os.IsExist(err) {
+				// created by another worker
+				continue
+			}
+			return err
+		}
+		if m&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != 0 {
+			// Mkdir does not set them in all platforms
+			if err := os.Chmod(d, m); err != nil {
+				return err
+			}
+		}
+		if parent {
+			if err := fr.parentOwners(d, inherited); err != nil {
+				return err
+			}
+		}
+		fr.cmutex.Lock()
+		fr.Created[d] = m
+		fr.cmutex.Unlock()
+		log.Debugf("Folder %s created successfully", d)
+	}
+	return nil
+}
+
+// parentMode returns the mode for a parent folder
+func (fr *Replicator) parentMode(mode os.FileMode, inherited *fs.Stat) os.FileMode {
+	if fr.Parents.Mode != 0 {
+		return fr.Parents.Mode
+	} else if inherited != nil {
+		return inherited.Mode & (os.ModePerm | os.ModeSetgid | os.ModeSticky)
+	}
+	return mode
+}
+
+// parentOwners sets the owners defined for the parent folder d
+func (fr *Replicator) parentOwners(d string, inherited *fs.Stat) error {
+	uid, gid := -1, -1
+	var err error
+	if fr.Parents.User != "" {
+		if uid, err = fs.LookupUser(fr.Parents.User); err != nil {
+			return err
+		}
+	} else if inherited != nil {
+		uid = inherited.Uid
+	}
+	if fr.Parents.Group != "" {
+		if gid, err = fs.LookupGroup(fr.Parents.Group); err != nil {
 			return err
 		}
-		log.Debugf("Folder %s created successfully", dst)
+	} else if inherited != nil {
+		gid = inherited.Gid
+	}
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+	if err = os.Chown(d, uid, gid); err != nil {
+		return fmt.Errorf("Cannot set owner (%d) and/or group (%d) to '%s': %s", uid, gid, d, err)
 	}
 	return nil
 }
 
-func (fr *Replicator) copyfile(src, dst string, dirmode, filemode os.FileMode) (int64, error) {
+func (fr *Replicator) copyfile(src, dst string, offset int64, dirmode, filemode os.FileMode) (int64, error) {
 	if err := fr.mkdir(filepath.Dir(dst), dirmode); err != nil {
 		return 0, err
 	}
@@ -80,7 +208,12 @@ func (fr *Replicator) copyfile(src, dst string, dirmode, filemode os.FileMode) (
 		return 0, err
 	}
 	defer source.Close()
-	destination, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE, filemode)
+	if offset > 0 {
+		if _, err = source.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+	destination, err := os.OpenFile(dst, os.O_TRUNC|os.O_RDWR|os.O_CREATE, filemode)
 	if err != nil {
 		return 0, err
 	}
@@ -94,16 +227,39 @@ func (fr *Replicator) copyfile(src, dst string, dirmode, filemode os.FileMode) (
 	return bytes, err
 }
 
-func (fr *Replicator) Function(base string, path string, i os.FileMode) (dst string, err error) {
-	dst = filepath.Join(fr.DstPath, path)
-	src := filepath.Join(base, path)
-	if i.IsDir() {
-		err = fr.mkdir(dst, i)
+func (fr *Replicator) Function(item *fs.Item) (dst string, err error) {
+	return fr.replicate(item, filepath.Join(fr.DstPath, item.Path), nil)
+}
+
+// replicate copies the item to dst, skipping the front matter and
+// applying its settings if fm is defined
+func (fr *Replicator) replicate(item *fs.Item, dst string, fm *FrontMatter) (string, error) {
+	var err error
+	src := filepath.Join(item.Base, item.Path)
+	if item.Mode.IsDir() {
+		if err = fr.mkdirItem(dst, item.Mode); err == nil {
+			if err = fr.preserve(item, src, dst); err == nil {
+				err = fr.applyConfig(item, dst)
+			}
+		}
 	} else {
-		_, err = fr.copyfile(src, dst, os.FileMode(0755), i)
+		var offset int64
+		if fm != nil {
+			offset = fm.Offset
+		}
+		_, err = fr.copyfile(src, dst, offset, os.FileMode(0755), fm.FileMode(item.Mode))
 		if err == nil {
-			err = fr.applyPermissions(dst)
+			// explicit settings are applied after the preserved ones
+			if err = fr.preserve(item, src, dst); err == nil {
+				if err = fr.applyPermissions(dst); err == nil {
+					if err = fr.applyConfig(item, dst); err == nil {
+						if err = fm.Set(dst); err == nil {
+							err = fr.setTimes(item, dst)
+						}
+					}
+				}
+			}
 		}
 	}
-	return
+	return dst, err
 }
@@ -16,8 +16,9 @@ package actions
 
 import (
 	"fmt"
-	"os"
 	"strings"
+
+	fs "confinit/pkg/fs"
 )
 
 // Execute is an interface to define a configurator factory
@@ -32,10 +33,16 @@ type Execute interface {
 
 type Runner struct {
 	*Templator
-	Render bool
-	Cmd    string
-	Exec   Execute
-	Dir    string
+	Render      bool
+	Cmd         string
+	Exec        Execute
+	Dir         string
+	Timeout     int
+	MaxCommands int
+	// NewExec returns a new Execute for each command (if defined), it
+	// allows running commands in parallel
+	NewExec func() Execute
+	cmds    chan struct{}
 }
 
 func NewRunner(glob, dst string, force, skipext, render bool, excludes []string) (*Runner, error) {
@@ -44,8 +51,10 @@ func NewRunner(glob, dst string, force, skipext, render bool, excludes []string)
 		return nil, err
 	}
 	r := Runner{
-		Templator: tpl,
-		Render:    render,
+		Templator:   tpl,
+		Render:      render,
+		MaxCommands: 1,
+		cmds:        make(chan struct{}, 1),
 	}
 	return &r, nil
 }
@@ -55,10 +64,25 @@ func (tr *Runner) SetRunner(exec Execute, env map[string]string, timeout int, di
 	tr.Exec = exec
 	tr.Env = env
 	tr.Dir = dir
+	tr.Timeout = timeout
 	tr.Exec.SetTimeout(timeout)
 	tr.Exec.SetEnv(env)
 }
 
+// SetExecFactory defines the function to create an Execute per command
+func (tr *Runner) SetExecFactory(f func() Execute) {
+	tr.NewExec = f
+}
+
+// SetMaxCommands limits the number of commands running at the same time
+func (tr *Runner) SetMaxCommands(n int) {
+	if n < 1 {
+		n = 1
+	}
+	tr.MaxCommands = n
+	tr.cmds = make(chan struct{}, n)
+}
+
 func (tr *Runner) AddEnv(env map[string]string) {
 	for key, value := range env {
 		tr.Env[key] = value
@@ -66,21 +90,33 @@ func (tr *Runner) AddEnv(env map[string]string) {
 	tr.Exec.SetEnv(tr.Env)
 }
 
-func (tr *Runner) Function(base string, path string, i os.FileMode) (dst string, err error) {
-	tpldata := tr.NewTemplateData(base, path, i)
+func (tr *Runner) Function(item *fs.Item) (dst string, err error) {
+	tpldata, err := tr.NewTemplateData(item)
+	if err != nil {
+		return "", err
+	}
+	return tr.run(tpldata, tr.Cmd, tr.Render)
+}
+
+// run renders the template (if render) and executes cmd
+func (tr *Runner) run(tpldata *TemplateData, cmd string, render bool) (dst string, err error) {
 	if tr.DstPath != "" {
-		if tr.Render {
-			if dst, err = tr.Templator.Function(base, path, i); err != nil {
+		if render {
+			if dst, err = tr.render(tpldata); err != nil {
 				return
 			}
 		}
 	}
-	arg, errarg := tr.renderTemplateString("arg", tr.Cmd, tpldata)
+	arg, errarg := tr.renderTemplateString("arg", cmd, tpldata)
 	if errarg != nil {
-		err = fmt.Errorf("Cannot render process arg '%s', %s", tr.Cmd, errarg)
+		err = fmt.Errorf("Cannot render process arg '%s', %s", cmd, errarg)
 		return
 	}
 	command := strings.Fields(arg)
+	if len(command) == 0 {
+		err = fmt.Errorf("Empty command for '%s'", tpldata.SourceOrigin)
+		return
+	}
 	dst = arg
 	// run
 	homedir := tr.Dir
@@ -90,8 +126,16 @@ func (tr *Runner) Function(base string, path string, i os.FileMode) (dst string,
 			homedir = tpldata.SourcePath
 		}
 	}
-	tr.Exec.SetDir(homedir)
-	tr.Exec.Command(command)
-	_, err = tr.Exec.Run()
+	tr.cmds <- struct{}{}
+	defer func() { <-tr.cmds }()
+	exec := tr.Exec
+	if tr.NewExec != nil {
+		exec = tr.NewExec()
+		exec.SetTimeout(tr.Timeout)
+		exec.SetEnv(tr.Env)
+	}
+	exec.SetDir(homedir)
+	exec.Command(command)
+	_, err = exec.Run()
 	return
 }
@@ -17,9 +17,12 @@ package actions
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"text/template"
 
 	fs "confinit/pkg/fs"
@@ -32,6 +35,22 @@ type Templator struct {
 	Data    interface{}
 	Env     map[string]string
 	SkipExt bool
+	Origins map[string]string
+	// DstTemplate is a template to compute the destination of the files
+	DstTemplate string
+	// Extensions are the suffixes removed by SkipExt, any if empty
+	Extensions []string
+	// Renames rewrite the relative paths of the destinations
+	Renames []*Rename
+	// Binary is what to do with binary files, Binaries the ones found
+	Binary   string
+	Binaries map[string]string
+	bmutex   sync.Mutex
+	// template functions and parsed templates (condition and command)
+	// are the same for all files
+	funcs     template.FuncMap
+	templates map[string]*template.Template
+	mutex     sync.RWMutex
 }
 
 func NewTemplator(glob, dst string, force, skipext bool, excludes []string) (*Templator, error) {
@@ -49,6 +68,11 @@ func NewTemplator(glob, dst string, force, skipext bool, excludes []string) (*Te
 		Data:       nil,
 		Env:        env,
 		SkipExt:    skipext,
+		Origins:    make(map[string]string),
+		Binary:     BinaryCopy,
+		Binaries:   make(map[string]string),
+		funcs:      tfunc.TemplateFuncMap(),
+		templates:  make(map[string]*template.Template),
 	}
 	return &r, nil
 }
@@ -59,6 +83,12 @@ func (ft *Templator) AddEnv(env map[string]string) {
 	}
 }
 
+// SetOrigin defines the archive or url unpacked in the folder base, it
+// is used to describe the source files in messages
+func (ft *Templator) SetOrigin(base, origin string) {
+	ft.Origins[base] = origin
+}
+
 func (ft *Templator) AddData(data interface{}) (err error) {
 	// convert to map[string]interface{} if
 	// input is map[interface{}]interface{}
@@ -111,52 +141,282 @@ type TemplateData struct {
 	SourceFile      string
 	Path            string
 	SourceFullPath  string
+	SourceOrigin    string
 	SourceAbsPath   string
 	SourcePath      string
 	Ext             string
+	Layer           string
+	LayerIndex      int
 	DstBaseDir      string
 	Destination     string
 	DestinationPath string
 	Data            interface{}
 	Env             map[string]string
+	FrontMatter     *FrontMatter
+	// Key and Item are the element of the foreach expression
+	Key  interface{}
+	Item interface{}
+	item *fs.Item
+	// skipext removes the extension of the destination, extset is true
+	// if it was defined by the folder configuration or front matter
+	skipext bool
+	extset  bool
+	// skip is the reason to skip the item (a name rendered empty)
+	skip string
+	// templated is true if the destination was rendered
+	templated bool
+}
+
+func (ft *Templator) NewTemplateData(item *fs.Item) (*TemplateData, error) {
+	fm, err := readFrontMatter(item)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ft.newTemplateData(item, fm)
+	if err != nil {
+		return nil, err
+	}
+	if err = ft.destination(data); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
-func (ft *Templator) NewTemplateData(basedir, f string, i os.FileMode) *TemplateData {
-	dstf := f
-	if ft.SkipExt && !i.IsDir() {
-		dstf = strings.TrimSuffix(f, filepath.Ext(f))
+// readFrontMatter returns the front matter of the item, only regular
+// files have one
+func readFrontMatter(item *fs.Item) (*FrontMatter, error) {
+	if !item.Mode.IsRegular() {
+		return nil, nil
+	}
+	return ReadFrontMatter(filepath.Join(item.Base, item.Path))
+}
+
+// newTemplateData returns the data of the item with its front matter
+// fm, without destination
+func (ft *Templator) newTemplateData(item *fs.Item, fm *FrontMatter) (*TemplateData, error) {
+	basedir, f, i := item.Base, item.Path, item.Mode
+	fullpath := filepath.Join(basedir, f)
+	skipext, extset := ft.SkipExt, false
+	if item.Config != nil && item.Config.Operation.DelExtension != nil {
+		skipext, extset = *item.Config.Operation.DelExtension, true
+	}
+	if fm != nil && fm.DelExtension != nil {
+		skipext, extset = *fm.DelExtension, true
 	}
 	dir, err := os.Getwd()
 	if err != nil {
 		dir = ""
 	}
 	abspath := filepath.Join(dir, basedir, f)
-	fullpath := filepath.Join(basedir, f)
-	dstpath := filepath.Join(ft.DstPath, dstf)
+	origin := fullpath
+	if o, ok := ft.Origins[basedir]; ok {
+		origin = o + "!/" + f
+	}
 	data := TemplateData{
-		IsDir:           i.IsDir(),
-		Mode:            i.String(),
-		SourceFile:      f,
-		SourceBaseDir:   basedir,
-		Source:          filepath.Base(f),
-		Filename:        filepath.Base(dstf),
-		Ext:             filepath.Ext(filepath.Base(dstf)),
-		SourceFullPath:  fullpath,
-		SourceAbsPath:   abspath,
-		SourcePath:      filepath.Dir(fullpath),
-		DstBaseDir:      ft.DstPath,
-		Destination:     dstpath,
-		DestinationPath: filepath.Dir(dstpath),
-		Env:             ft.Env,
-		Data:            ft.Data,
-	}
-	return &data
+		IsDir:          i.IsDir(),
+		Mode:           i.String(),
+		SourceFile:     f,
+		SourceBaseDir:  basedir,
+		Source:         filepath.Base(f),
+		SourceFullPath: fullpath,
+		SourceOrigin:   origin,
+		SourceAbsPath:  abspath,
+		SourcePath:     filepath.Dir(fullpath),
+		Layer:          item.Base,
+		LayerIndex:     item.Layer,
+		DstBaseDir:     ft.DstPath,
+		Env:            ft.Env,
+		Data:           ft.Data,
+		FrontMatter:    fm,
+		item:           item,
+		skipext:        skipext,
+		extset:         extset,
+	}
+	if item.Config != nil && len(item.Config.Operation.Data) > 0 {
+		if data.Data, err = mergeData(data.Data, item.Config.Operation.Data); err != nil {
+			return nil, fmt.Errorf("Cannot add data from %v for '%s': %s", item.Config.Files, origin, err)
+		}
+	}
+	if fm != nil && len(fm.Data) > 0 {
+		if data.Data, err = mergeData(data.Data, fm.Data); err != nil {
+			return nil, fmt.Errorf("Cannot add data from front matter of '%s': %s", origin, err)
+		}
+	}
+	return &data, nil
+}
+
+// Rename rewrites the paths matching Regex with Replace, which can
+// use the groups of the regex ($1, ${name})
+type Rename struct {
+	Regex   *regexp.Regexp
+	Replace string
+}
+
+// AddRename adds a rule to rewrite the relative paths of the
+// destinations, rules are applied in order
+func (ft *Templator) AddRename(regex, replace string) error {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return fmt.Errorf("Invalid rename pattern '%s', %s", regex, err)
+	}
+	ft.Renames = append(ft.Renames, &Rename{Regex: re, Replace: replace})
+	return nil
+}
+
+// SetExtensions defines the suffixes removed from the destinations,
+// without suffixes any extension is removed
+func (ft *Templator) SetExtensions(suffixes ...string) {
+	ft.Extensions = suffixes
+}
+
+// trimExtension removes the extension of name
+func (ft *Templator) trimExtension(name string) string {
+	if len(ft.Extensions) == 0 {
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	for _, ext := range ft.Extensions {
+		if strings.HasSuffix(name, ext) && name != ext && !strings.HasSuffix(name, string(filepath.Separator)+ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// rename applies the rename rules to the relative path p, it returns
+// true if the path changed
+func (ft *Templator) rename(p string) (string, bool) {
+	result := p
+	for _, r := range ft.Renames {
+		result = r.Regex.ReplaceAllString(result, r.Replace)
+	}
+	return result, result != p
+}
+
+// SetDestinationTemplate defines a template to compute the destination
+// of the files, relative to the destination folder or absolute
+func (ft *Templator) SetDestinationTemplate(tpl string) {
+	ft.DstTemplate = tpl
+}
+
+// destination computes the destination of data: names of the source path
+// with {{ }} are rendered (an empty name skips the item), then the rename
+// rules are applied, the extension is removed (skipext) and finally the
+// destination template and the front matter destination are applied
+func (ft *Templator) destination(data *TemplateData) error {
+	sep := string(filepath.Separator)
+	data.skip, data.templated = "", false
+	dstf := data.SourceFile
+	if strings.Contains(dstf, "{{") {
+		parts := strings.Split(dstf, sep)
+		for i, part := range parts {
+			if !strings.Contains(part, "{{") {
+				continue
+			}
+			name, err := ft.renderTemplateString("name", part, data)
+			if err != nil {
+				return fmt.Errorf("Cannot render name '%s' of %s, %s", part, data.SourceOrigin, err)
+			}
+			if name = strings.TrimSpace(name); name == "" {
+				data.skip = fmt.Sprintf("name '%s' rendered empty", part)
+				return nil
+			} else if strings.Contains(name, sep) || name == "." || name == ".." {
+				return fmt.Errorf("Invalid name '%s' rendered from '%s' of %s", name, part, data.SourceOrigin)
+			}
+			parts[i] = name
+		}
+		dstf = filepath.Join(parts...)
+		data.templated = true
+	}
+	if name, ok := ft.rename(dstf); ok {
+		if name = filepath.Clean(name); name == "." || name == sep {
+			return fmt.Errorf("Invalid destination '%s' renamed from '%s'", name, dstf)
+		}
+		dstf = name
+		data.templated = true
+	}
+	if data.skipext && !data.IsDir {
+		dstf = ft.trimExtension(dstf)
+	}
+	dstpath := dstf
+	if !filepath.IsAbs(dstpath) {
+		dstpath = filepath.Join(ft.DstPath, dstf)
+	}
+	if ft.DstTemplate != "" && !data.IsDir {
+		// the template can use the default destination
+		data.setDestination(dstpath)
+		name, err := ft.renderTemplateString("destination", ft.DstTemplate, data)
+		if err != nil {
+			return fmt.Errorf("Cannot render destination '%s' of %s, %s", ft.DstTemplate, data.SourceOrigin, err)
+		}
+		if name = strings.TrimSpace(name); name == "" {
+			data.skip = "destination rendered empty"
+			return nil
+		}
+		dstpath = name
+		if !filepath.IsAbs(dstpath) {
+			dstpath = filepath.Join(ft.DstPath, dstpath)
+		}
+		data.templated = true
+	}
+	if fm := data.FrontMatter; fm != nil && fm.Destination != "" {
+		dstpath = fm.Destination
+		if !filepath.IsAbs(dstpath) {
+			dstpath = filepath.Join(ft.DstPath, dstpath)
+		}
+	}
+	data.setDestination(dstpath)
+	return nil
+}
+
+func (data *TemplateData) setDestination(dst string) {
+	data.Destination = dst
+	data.DestinationPath = filepath.Dir(dst)
+	data.Filename = filepath.Base(dst)
+	data.Ext = filepath.Ext(data.Filename)
+}
+
+// mergeData returns a new map with the keys of data and the keys of
+// extra, without modifying data
+func mergeData(data interface{}, extra map[string]interface{}) (interface{}, error) {
+	m := make(map[string]interface{})
+	switch d := data.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, v := range d {
+			m[k] = v
+		}
+	default:
+		return nil, fmt.Errorf("Cannot add/mix Data source type Map with other Data source(s)")
+	}
+	for k, v := range extra {
+		m[k] = v
+	}
+	return m, nil
+}
+
+// parse returns the template value, parsing it only the first time
+func (ft *Templator) parse(name, value string) (*template.Template, error) {
+	key := name + ":" + value
+	ft.mutex.RLock()
+	tpl, ok := ft.templates[key]
+	ft.mutex.RUnlock()
+	if ok {
+		return tpl, nil
+	}
+	tpl, err := template.New(name).Funcs(ft.funcs).Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	ft.mutex.Lock()
+	ft.templates[key] = tpl
+	ft.mutex.Unlock()
+	return tpl, nil
 }
 
 func (ft *Templator) renderTemplateString(name, value string, data *TemplateData) (string, error) {
 	// A Buffer needs no initialization.
 	var render bytes.Buffer
-	tpl, err := template.New(name).Funcs(tfunc.TemplateFuncMap()).Parse(value)
+	tpl, err := ft.parse(name, value)
 	if err != nil {
 		return "", err
 	}
@@ -170,13 +430,21 @@ func (ft *Templator) renderTemplate(data *TemplateData, dirmode, filemode os.Fil
 	if err := ft.mkdir(filepath.Dir(data.Destination), dirmode); err != nil {
 		return err
 	}
-	tpl, err := template.New(data.Source).Funcs(tfunc.TemplateFuncMap()).ParseFiles(data.SourceFullPath)
+	content, err := ioutil.ReadFile(data.SourceFullPath)
 	if err != nil {
 		return err
 	}
+	if data.FrontMatter != nil {
+		content = content[data.FrontMatter.Offset:]
+	}
+	tpl, err := template.New(data.Source).Funcs(ft.funcs).Parse(string(content))
+	if err != nil {
+		return fmt.Errorf("Cannot parse template %s, %s", data.SourceOrigin, err)
+	}
 	if ft.FileMode != 0 {
 		filemode = ft.FileMode
 	}
+	filemode = data.FrontMatter.FileMode(filemode)
 	dst, err := os.OpenFile(data.Destination, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, filemode)
 	if err != nil {
 		err = fmt.Errorf("Cannot create file %s, %s", data.Destination, err)
@@ -186,21 +454,52 @@ func (ft *Templator) renderTemplate(data *TemplateData, dirmode, filemode os.Fil
 	if err := tpl.Execute(dst, data); err != nil {
 		return err
 	}
-	log.Debugf("Successfully rendered template '%s' to '%s'", data.SourceFullPath, data.Destination)
+	log.Debugf("Successfully rendered template '%s' to '%s'", data.SourceOrigin, data.Destination)
 	return nil
 }
 
-func (ft *Templator) Function(base string, path string, i os.FileMode) (dst string, err error) {
-	if i.IsDir() {
-		// Using always default mode (is not replicate)
-		err = ft.mkdir(filepath.Join(ft.DstPath, path), i)
-	} else {
-		tpldata := ft.NewTemplateData(base, path, i)
-		dst = tpldata.Destination
-		err = ft.renderTemplate(tpldata, os.FileMode(0755), i)
-		if err == nil {
-			err = ft.applyPermissions(dst)
+// render processes the template defined by data
+func (ft *Templator) render(data *TemplateData) (dst string, err error) {
+	// the mode of the source (of the target for links), the default
+	// modes and the front matter override it
+	mode := data.item.Mode
+	if data.item.Stat != nil {
+		mode = data.item.Stat.Mode
+	}
+	if data.IsDir {
+		dst = data.Destination
+		if err = ft.mkdirItem(dst, mode); err == nil {
+			err = ft.applyConfig(data.item, dst)
+		}
+		return
+	}
+	dst = data.Destination
+	err = ft.renderTemplate(data, os.FileMode(0755), mode)
+	if err == nil {
+		if err = ft.applyPermissions(dst); err == nil {
+			if err = ft.applyConfig(data.item, dst); err == nil {
+				err = data.FrontMatter.Set(dst)
+			}
 		}
 	}
 	return
 }
+
+func (ft *Templator) Function(item *fs.Item) (dst string, err error) {
+	tpldata, err := ft.NewTemplateData(item)
+	if err != nil {
+		return "", err
+	} else if tpldata.skip != "" {
+		log.Infof("Skipping %s, %s", tpldata.SourceOrigin, tpldata.skip)
+		return "", nil
+	}
+	switch b, err := ft.binary(tpldata); {
+	case err != nil:
+		return "", err
+	case b == BinarySkip:
+		return "", nil
+	case b == BinaryCopy:
+		return ft.replicate(item, tpldata.Destination, tpldata.FrontMatter)
+	}
+	return ft.render(tpldata)
+}
@@ -0,0 +1,46 @@
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// benchFiles is the size of the trees of the benchmarks
+const benchFiles = 20000
+
+// benchCondition renders one of each ten files
+const benchCondition = `{{ if not (hasSuffix "1.conf" .Source) }}skip{{ end }}`
+
+// BenchmarkRunTree20kCondition runs an operation with a condition on a
+// tree of 20k files, half of them processed by a previous operation
+func BenchmarkRunTree20kCondition(b *testing.B) {
+	src := generateTree(b, benchFiles, plainTemplate)
+	defer os.RemoveAll(src)
+	excludes := make([]string, 0, benchFiles/2)
+	for i := 0; i < benchFiles; i += 2 {
+		excludes = append(excludes, fmt.Sprintf("d%03d/f%05d.conf", i/100, i))
+	}
+	f := scanTree(b, src, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dst, _ := ioutil.TempDir("", "confinit")
+		a, err := NewActionRouter(".*", dst, true, false, true, excludes)
+		if err != nil {
+			b.Fatal(err)
+		}
+		a.SetCondition(benchCondition)
+		b.StartTimer()
+		if err = f.Run(a); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		if n := len(a.ListOutputs()); n != benchFiles/10 {
+			b.Fatalf("Expected %d files rendered, got %d", benchFiles/10, n)
+		}
+		os.RemoveAll(dst)
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// CapabilityXattr is the extended attribute with the file capabilities
+const CapabilityXattr = "security.capability"
+
+const (
+	vfsCapRevision2   = 0x02000000
+	vfsCapFlagsEffect = 0x000001
+)
+
+// capabilities are the names of the Linux capabilities (without "cap_")
+// by their number
+var capabilities = []string{
+	"chown", "dac_override", "dac_read_search", "fowner", "fsetid", "kill",
+	"setgid", "setuid", "setpcap", "linux_immutable", "net_bind_service",
+	"net_broadcast", "net_admin", "net_raw", "ipc_lock", "ipc_owner",
+	"sys_module", "sys_rawio", "sys_chroot", "sys_ptrace", "sys_pacct",
+	"sys_admin", "sys_boot", "sys_nice", "sys_resource", "sys_time",
+	"sys_tty_config", "mknod", "lease", "audit_write", "audit_control",
+	"setfcap", "mac_override", "mac_admin", "syslog", "wake_alarm",
+	"block_suspend", "audit_read", "perfmon", "bpf", "checkpoint_restore",
+}
+
+// capabilityMask returns the bits of the comma separated list of names
+func capabilityMask(names string) (uint64, error) {
+	var mask uint64
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "all" {
+			mask |= 1<<uint(len(capabilities)) - 1
+			continue
+		}
+		found := false
+		for i, c := range capabilities {
+			if "cap_"+c == name {
+				mask |= 1 << uint(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown capability '%s'", name)
+		}
+	}
+	return mask, nil
+}
+
+// ParseCapabilities converts the textual form of capabilities used by
+// setcap (like "cap_net_bind_service,cap_net_raw+ep") in the value of the
+// security.capability extended attribute. Clauses are separated by spaces
+// and the operators are "=", "+" and "-" with the flags "e", "i" and "p".
+func ParseCapabilities(text string) ([]byte, error) {
+	var permitted, inheritable, effective uint64
+	for _, clause := range strings.Fields(text) {
+		i := strings.IndexAny(clause, "=+-")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid capabilities '%s', missing operator in '%s'", text, clause)
+		}
+		var mask uint64
+		if names := clause[:i]; names != "" {
+			m, err := capabilityMask(names)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid capabilities '%s', %s", text, err)
+			}
+			mask = m
+		} else if clause[i] == '=' {
+			// "=ep" means all the capabilities
+			mask = 1<<uint(len(capabilities)) - 1
+		}
+		rest := clause[i:]
+		for rest != "" {
+			op := rest[0]
+			j := strings.IndexAny(rest[1:], "=+-")
+			if j < 0 {
+				j = len(rest) - 1
+			}
+			flags := rest[1 : j+1]
+			rest = rest[j+1:]
+			if op == '=' {
+				permitted, inheritable, effective = permitted&^mask, inheritable&^mask, effective&^mask
+			}
+			for _, f := range flags {
+				var set *uint64
+				switch f {
+				case 'p':
+					set = &permitted
+				case 'i':
+					set = &inheritable
+				case 'e':
+					set = &effective
+				default:
+					return nil, fmt.Errorf("Invalid capabilities '%s', unknown flag '%c'", text, f)
+				}
+				if op == '-' {
+					*set &^= mask
+				} else {
+					*set |= mask
+				}
+			}
+		}
+	}
+	// The effective set of files is a single flag
+	magic := uint32(vfsCapRevision2)
+	if effective != 0 {
+		if effective != permitted|inheritable {
+			return nil, fmt.Errorf("Invalid capabilities '%s', effective flag must apply to all of them", text)
+		}
+		magic |= vfsCapFlagsEffect
+	}
+	value := make([]byte, 20)
+	binary.LittleEndian.PutUint32(value[0:], magic)
+	binary.LittleEndian.PutUint32(value[4:], uint32(permitted))
+	binary.LittleEndian.PutUint32(value[8:], uint32(inheritable))
+	binary.LittleEndian.PutUint32(value[12:], uint32(permitted>>32))
+	binary.LittleEndian.PutUint32(value[16:], uint32(inheritable>>32))
+	return value, nil
+}
@@ -0,0 +1,337 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DirConfigFile is the name of the files with settings for a folder
+// and all its subfolders. They are never processed as source files.
+const DirConfigFile = ".confinit.yml"
+
+type DirMode struct {
+	Dir  string `yaml:"folder"`
+	File string `yaml:"file"`
+}
+
+type DirDefault struct {
+	Mode  DirMode `yaml:"mode"`
+	User  string  `yaml:"user"`
+	Group string  `yaml:"group"`
+}
+
+type DirPermission struct {
+	Glob  string `yaml:"glob"`
+	Mode  string `yaml:"mode"`
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+}
+
+// DirOperation overrides the settings of the operations for the files
+// of the folder
+type DirOperation struct {
+	Template     *bool                  `yaml:"template"`
+	DelExtension *bool                  `yaml:"delextension"`
+	Condition    *string                `yaml:"condition"`
+	Command      []string               `yaml:"command"`
+	Data         map[string]interface{} `yaml:"data"`
+}
+
+// DirConfig are the settings of a .confinit.yml file. Once merged
+// with the settings of the parent folders, it is the effective
+// configuration for the items of a folder.
+type DirConfig struct {
+	Match       []string         `yaml:"match"`
+	Skip        []string         `yaml:"skip"`
+	Default     DirDefault       `yaml:"default"`
+	Permissions []*DirPermission `yaml:"permissions"`
+	Operation   DirOperation     `yaml:"operation"`
+	// Files are the .confinit.yml files merged, from top to bottom
+	Files []string `yaml:"-"`
+	rules []*dirRule
+	perms []*dirPerm
+}
+
+// dirRule are the match and skip globs of one folder, relative to it
+type dirRule struct {
+	base  string
+	match []*Glob
+	skip  []*Glob
+}
+
+// dirPerm are attributes for the items matching glob (all if nil)
+type dirPerm struct {
+	base    string
+	glob    *Glob
+	user    string
+	group   string
+	mode    *ModeSpec
+	dirmode *ModeSpec
+}
+
+// Attributes are the mode and owners of an item, empty values are
+// not changed
+type Attributes struct {
+	Mode  *ModeSpec
+	User  string
+	Group string
+}
+
+func compileGlobs(globs []string, path bool) ([]*Glob, error) {
+	var result []*Glob
+	for _, g := range globs {
+		pattern, err := CompileGlob(g, path)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid glob pattern '%s', %s", g, err)
+		}
+		result = append(result, pattern)
+	}
+	return result, nil
+}
+
+// ReadDirConfig loads the file p, which defines the settings of the
+// folder base (relative to the source). Globs are path aware if path
+// is true.
+func ReadDirConfig(p, base string, path bool) (*DirConfig, error) {
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	c := DirConfig{}
+	if err = yaml.UnmarshalStrict(content, &c); err != nil {
+		return nil, fmt.Errorf("Invalid folder configuration '%s', %s", p, err)
+	}
+	c.Files = []string{p}
+	rule := &dirRule{base: base}
+	if rule.match, err = compileGlobs(c.Match, path); err != nil {
+		return nil, fmt.Errorf("Invalid folder configuration '%s', %s", p, err)
+	}
+	if rule.skip, err = compileGlobs(c.Skip, path); err != nil {
+		return nil, fmt.Errorf("Invalid folder configuration '%s', %s", p, err)
+	}
+	c.rules = []*dirRule{rule}
+	def := &dirPerm{
+		base:  base,
+		user:  c.Default.User,
+		group: c.Default.Group,
+	}
+	if def.mode, err = ParseMode(c.Default.Mode.File); err != nil {
+		return nil, fmt.Errorf("Invalid folder configuration '%s', default %s", p, err)
+	}
+	if def.dirmode, err = ParseMode(c.Default.Mode.Dir); err != nil {
+		return nil, fmt.Errorf("Invalid folder configuration '%s', default %s", p, err)
+	}
+	c.perms = []*dirPerm{def}
+	for _, perm := range c.Permissions {
+		dp := &dirPerm{
+			base:  base,
+			user:  perm.User,
+			group: perm.Group,
+		}
+		if dp.glob, err = CompileGlob(perm.Glob, path); err != nil {
+			return nil, fmt.Errorf("Invalid folder configuration '%s', glob pattern '%s', %s", p, perm.Glob, err)
+		}
+		if dp.mode, err = ParseMode(perm.Mode); err != nil {
+			return nil, fmt.Errorf("Invalid folder configuration '%s', permissions %s", p, err)
+		}
+		dp.dirmode = dp.mode
+		c.perms = append(c.perms, dp)
+	}
+	return &c, nil
+}
+
+// Merge returns a new configuration with the settings of c overridden
+// by the ones of child
+func (c *DirConfig) Merge(child *DirConfig) *DirConfig {
+	if c == nil {
+		return child
+	}
+	if child == nil {
+		return c
+	}
+	m := DirConfig{
+		Match:       append(append([]string{}, c.Match...), child.Match...),
+		Skip:        append(append([]string{}, c.Skip...), child.Skip...),
+		Default:     c.Default,
+		Permissions: append(append([]*DirPermission{}, c.Permissions...), child.Permissions...),
+		Operation:   c.Operation,
+		Files:       append(append([]string{}, c.Files...), child.Files...),
+		rules:       append(append([]*dirRule{}, c.rules...), child.rules...),
+		perms:       append(append([]*dirPerm{}, c.perms...), child.perms...),
+	}
+	if child.Default.User != "" {
+		m.Default.User = child.Default.User
+	}
+	if child.Default.Group != "" {
+		m.Default.Group = child.Default.Group
+	}
+	if child.Default.Mode.File != "" {
+		m.Default.Mode.File = child.Default.Mode.File
+	}
+	if child.Default.Mode.Dir != "" {
+		m.Default.Mode.Dir = child.Default.Mode.Dir
+	}
+	if child.Operation.Template != nil {
+		m.Operation.Template = child.Operation.Template
+	}
+	if child.Operation.DelExtension != nil {
+		m.Operation.DelExtension = child.Operation.DelExtension
+	}
+	if child.Operation.Condition != nil {
+		m.Operation.Condition = child.Operation.Condition
+	}
+	if len(child.Operation.Command) > 0 {
+		m.Operation.Command = child.Operation.Command
+	}
+	if len(child.Operation.Data) > 0 {
+		m.Operation.Data = make(map[string]interface{})
+		for k, v := range c.Operation.Data {
+			m.Operation.Data[k] = v
+		}
+		for k, v := range child.Operation.Data {
+			m.Operation.Data[k] = v
+		}
+	}
+	return &m
+}
+
+// relative returns the path p relative to the folder base
+func relative(base, p string) string {
+	if rel, err := filepath.Rel(base, p); err == nil {
+		return rel
+	}
+	return p
+}
+
+// Allowed returns false if the path p (relative to the source) is skipped
+// or it does not match the globs defined in the folders. Match globs
+// only apply to files.
+func (c *DirConfig) Allowed(p string, dir bool) (bool, string) {
+	if c == nil {
+		return true, ""
+	}
+	for _, r := range c.rules {
+		rel := relative(r.base, p)
+		for _, g := range r.skip {
+			if g.MatchString(rel) {
+				return false, fmt.Sprintf("skip glob '%s' in '%s'", g, r.base)
+			}
+		}
+		if dir || len(r.match) == 0 {
+			continue
+		}
+		match := false
+		for _, g := range r.match {
+			if g.MatchString(rel) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false, fmt.Sprintf("not matching globs %v in '%s'", r.match, r.base)
+		}
+	}
+	return true, ""
+}
+
+// Attributes returns the mode and owners defined for the path p
+// (relative to the source)
+func (c *DirConfig) Attributes(p string, dir bool) *Attributes {
+	a := Attributes{}
+	if c == nil {
+		return &a
+	}
+	for _, perm := range c.perms {
+		if perm.glob != nil && !perm.glob.MatchString(relative(perm.base, p)) {
+			continue
+		}
+		if dir && perm.dirmode != nil {
+			a.Mode = perm.dirmode
+		} else if !dir && perm.mode != nil {
+			a.Mode = perm.mode
+		}
+		if perm.user != "" {
+			a.User = perm.user
+		}
+		if perm.group != "" {
+			a.Group = perm.group
+		}
+	}
+	return &a
+}
+
+// Describe returns the effective settings for the path p
+func (c *DirConfig) Describe(p string, dir bool) string {
+	a := c.Attributes(p, dir)
+	s := []string{fmt.Sprintf("from %v", c.Files), a.String()}
+	if o := c.Operation; o.Template != nil {
+		s = append(s, fmt.Sprintf("template=%t", *o.Template))
+	}
+	if o := c.Operation; o.DelExtension != nil {
+		s = append(s, fmt.Sprintf("delextension=%t", *o.DelExtension))
+	}
+	if o := c.Operation; o.Condition != nil {
+		s = append(s, fmt.Sprintf("condition='%s'", *o.Condition))
+	}
+	if o := c.Operation; len(o.Command) > 0 {
+		s = append(s, fmt.Sprintf("command=%v", o.Command))
+	}
+	if o := c.Operation; len(o.Data) > 0 {
+		s = append(s, fmt.Sprintf("data=%v", o.Data))
+	}
+	return strings.Join(s, " ")
+}
+
+func (a *Attributes) String() string {
+	return fmt.Sprintf("mode=%s user=%s group=%s", a.Mode, a.User, a.Group)
+}
+
+// Set applies the defined attributes to the path p
+func (a *Attributes) Set(p string) error {
+	if a.Mode != nil {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if err = os.Chmod(p, a.Mode.Apply(fi.Mode(), fi.IsDir())); err != nil {
+			return fmt.Errorf("Cannot set mode (%s) to '%s': %s", a.Mode, p, err)
+		}
+	}
+	uid, gid := -1, -1
+	var err error
+	if a.User != "" {
+		if uid, err = LookupUser(a.User); err != nil {
+			return err
+		}
+	}
+	if a.Group != "" {
+		if gid, err = LookupGroup(a.Group); err != nil {
+			return err
+		}
+	}
+	if uid >= 0 || gid >= 0 {
+		if err = os.Chown(p, uid, gid); err != nil {
+			return fmt.Errorf("Cannot set owner (%d) and/or group (%d) to '%s': %s", uid, gid, p, err)
+		}
+	}
+	return nil
+}
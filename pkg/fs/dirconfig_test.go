@@ -0,0 +1,50 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirConfigModes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "confinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	config := filepath.Join(tmp, DirConfigFile)
+	content := "default:\n  mode:\n    file: \"u=rw,go=\"\n    folder: \"0700\"\npermissions:\n  - glob: \"*.sh\"\n    mode: \"a+x\"\n"
+	if err = ioutil.WriteFile(config, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadDirConfig(config, ".", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]os.FileMode{"app.conf": 0600, "run.sh": 0755, "sub": 0700}
+	for name, mode := range expected {
+		p := filepath.Join(tmp, name)
+		dir := name == "sub"
+		if dir {
+			err = os.Mkdir(p, 0755)
+		} else {
+			err = ioutil.WriteFile(p, nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.Attributes(name, dir).Set(p); err != nil {
+			t.Fatal(err)
+		}
+		if fi, _ := os.Stat(p); fi.Mode().Perm() != mode {
+			t.Errorf("Mode of %s is %s, expected %s", name, fi.Mode().Perm(), mode)
+		}
+	}
+	if err = ioutil.WriteFile(config, []byte("default:\n  mode:\n    file: \"u+q\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadDirConfig(config, ".", false); err == nil {
+		t.Errorf("Invalid mode accepted")
+	}
+}
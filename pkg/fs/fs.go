@@ -20,74 +20,134 @@ import (
 	log "confinit/pkg/log"
 )
 
-type MapFile map[string]os.FileMode
+// Item is a file or folder found in one of the layers
+type Item struct {
+	Path  string
+	Base  string
+	Layer int
+	Mode  os.FileMode
+	// Stat is the metadata of the item (of the target for links)
+	Stat *Stat
+	// Config is the effective configuration of the folder (if any)
+	Config *DirConfig
+	// Changed is false if the item (and its folder configuration) did not
+	// change since the previous run, always true without scan index
+	Changed bool
+}
+
+type MapFile map[string]*Item
 
 type Fs struct {
 	CurrentPath  string
 	BasePath     string
-	SkipDirGlob  *Glob
-	SkipFileGlob *Glob
-	FileGlob     *Glob
-	DirGlob      *Glob
+	Layers       []string
+	PathGlobs    bool
+	Order        string
+	Workers      int
+	SkipDirGlob  Globs
+	SkipFileGlob Globs
+	FileGlob     Globs
+	DirGlob      Globs
+	Ignore       *Ignore
+	Index        *Index
 	files        MapFile
 	dirs         MapFile
 	skippedPaths []string
 	skippedFiles []string
+	configs      map[string]*DirConfig
+	ignores      map[string]*Ignore
+	layer        int
+	patterns     map[string][]string
+	changed      map[string]bool
 }
 
 // Option to pass to the constructor using Functional Options
 type Option func(*Fs)
 
+// PathGlobs is a function used by users to set options. If enabled
+// "*" does not match "/" and "**" matches any number of folders
+func PathGlobs(enabled bool) Option {
+	return func(f *Fs) {
+		f.PathGlobs = enabled
+	}
+}
+
+// Ordering is a function used by users to set options. It defines the
+// order of processing the items: OrderLexical (default) or OrderNatural
+func Ordering(order string) Option {
+	return func(f *Fs) {
+		f.Order = order
+	}
+}
+
+// Workers is a function used by users to set options. It defines how
+// many files are processed at the same time
+func Workers(n int) Option {
+	return func(f *Fs) {
+		f.Workers = n
+	}
+}
+
 // SkipDirGlob is a function used by users to set options.
-func SkipDirGlob(s string) Option {
+func SkipDirGlob(s ...string) Option {
 	return func(f *Fs) {
-		if s != "" {
-			if pattern, err := NewGlob(s); err != nil {
-				log.Errorf("Invalid SkipDir glob pattern '%s', %s", s, err.Error())
-			} else {
-				f.SkipDirGlob = pattern
-			}
-		}
+		f.patterns["SkipDir"] = append(f.patterns["SkipDir"], s...)
 	}
 }
 
 // SkipFileGlob is a function used by users to set options.
-func SkipFileGlob(s string) Option {
+func SkipFileGlob(s ...string) Option {
 	return func(f *Fs) {
-		if s != "" {
-			if pattern, err := NewGlob(s); err != nil {
-				log.Errorf("Invalid SkipFile glob pattern '%s', %s", s, err.Error())
-			} else {
-				f.SkipFileGlob = pattern
-			}
-		}
+		f.patterns["SkipFile"] = append(f.patterns["SkipFile"], s...)
 	}
 }
 
 // FileGlob is a function used by users to set options.
-func FileGlob(s string) Option {
+func FileGlob(s ...string) Option {
 	return func(f *Fs) {
-		if s != "" {
-			if pattern, err := NewGlob(s); err != nil {
-				log.Errorf("Invalid File glob pattern '%s', %s", s, err.Error())
-			} else {
-				f.FileGlob = pattern
-			}
-		}
+		f.patterns["File"] = append(f.patterns["File"], s...)
 	}
 }
 
 // DirGlob is a function used by users to set options.
-func DirGlob(s string) Option {
+func DirGlob(s ...string) Option {
 	return func(f *Fs) {
-		if s != "" {
-			if pattern, err := NewGlob(s); err != nil {
-				log.Errorf("Invalid Dir glob pattern '%s', %s", s, err.Error())
-			} else {
-				f.DirGlob = pattern
-			}
+		f.patterns["Dir"] = append(f.patterns["Dir"], s...)
+	}
+}
+
+// globs compiles the patterns defined by the options once all of them
+// are applied (they depend on PathGlobs)
+func (f *Fs) globs(kind string) Globs {
+	var globs Globs
+	for _, s := range f.patterns[kind] {
+		if s == "" {
+			continue
+		}
+		if pattern, err := CompileGlob(s, f.PathGlobs); err != nil {
+			log.Errorf("Invalid %s glob pattern '%s', %s", kind, s, err.Error())
+		} else {
+			globs = append(globs, pattern)
 		}
 	}
+	return globs
+}
+
+// IgnorePatterns is a function used by users to set options. The
+// patterns of the ignore file apply to the root of the source(s)
+func IgnorePatterns(ign *Ignore) Option {
+	return func(f *Fs) {
+		f.Ignore = ign
+	}
+}
+
+// ScanIndex is a function used by users to set options. The index
+// records the size, mtime, inode and mode of the scanned paths to know
+// which items changed since the previous run
+func ScanIndex(idx *Index) Option {
+	return func(f *Fs) {
+		f.Index = idx
+	}
 }
 
 // New is the contructor
@@ -96,20 +156,25 @@ func New(opts ...Option) *Fs {
 	if err != nil {
 		dir = "."
 	}
-	fglob, _ := NewGlob("*")
-	dglob, _ := NewGlob("*")
 	f := &Fs{
-		CurrentPath:  dir,
-		SkipDirGlob:  nil,
-		SkipFileGlob: nil,
-		FileGlob:     fglob,
-		DirGlob:      dglob,
-		files:        make(MapFile),
-		dirs:         make(MapFile),
+		CurrentPath: dir,
+		Order:       OrderLexical,
+		Workers:     1,
+		files:       make(MapFile),
+		dirs:        make(MapFile),
+		configs:     make(map[string]*DirConfig),
+		ignores:     make(map[string]*Ignore),
+		patterns:    make(map[string][]string),
+		changed:     make(map[string]bool),
 	}
 	// call option functions on instance to set options on it
 	for _, opt := range opts {
 		opt(f)
 	}
+	// Without add globs, everything is added
+	f.SkipDirGlob = f.globs("SkipDir")
+	f.SkipFileGlob = f.globs("SkipFile")
+	f.FileGlob = f.globs("File")
+	f.DirGlob = f.globs("Dir")
 	return f
 }
@@ -18,6 +18,7 @@ package fs
 
 import (
 	"regexp"
+	"strings"
 )
 
 // Glob is a wrapper of *regexp.Regexp.
@@ -25,19 +26,66 @@ import (
 type Glob struct {
 	*regexp.Regexp
 	Pattern string
+	// Path is true if "*" does not match "/"
+	Path bool
 }
 
 // NewGlob a takes a glob expression as a string and transforms it
 // into a *Glob object (which is really just a regular expression)
 // Compile also returns a possible error.
 func NewGlob(pattern string) (*Glob, error) {
-	r, err := globToRegex(pattern)
+	return CompileGlob(pattern, false)
+}
+
+// NewPathGlob compiles a path aware glob expression: "*" and "?" do
+// not match "/" and "**" matches any number of folders
+func NewPathGlob(pattern string) (*Glob, error) {
+	return CompileGlob(pattern, true)
+}
+
+// CompileGlob compiles a glob expression, path aware if path is true
+func CompileGlob(pattern string, path bool) (*Glob, error) {
+	r, err := globToRegex(pattern, path)
 	return &Glob{
 		Regexp:  r,
 		Pattern: pattern,
+		Path:    path,
 	}, err
 }
 
+// Globs is a list of glob expressions, matching if one of them matches
+type Globs []*Glob
+
+// NewGlobs compiles a list of glob expressions
+func NewGlobs(patterns []string, path bool) (Globs, error) {
+	var globs Globs
+	for _, p := range patterns {
+		g, err := CompileGlob(p, path)
+		if err != nil {
+			return nil, err
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+func (gs Globs) MatchString(s string) bool {
+	for _, g := range gs {
+		if g.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (gs Globs) String() string {
+	patterns := make([]string, len(gs))
+	for i, g := range gs {
+		patterns[i] = g.Pattern
+	}
+	return strings.Join(patterns, ",")
+}
+
 func (g *Glob) String() string {
 	return g.Pattern
 }
@@ -46,7 +94,7 @@ func (g *Glob) GetRegexp() string {
 	return g.Regexp.String()
 }
 
-func globToRegex(glob string) (*regexp.Regexp, error) {
+func globToRegex(glob string, path bool) (*regexp.Regexp, error) {
 	regex := ""
 	inGroup := 0
 	inClass := 0
@@ -72,14 +120,30 @@ func globToRegex(glob string) (*regexp.Regexp, error) {
 				regex += string(next)
 			}
 		case '*':
-			if inClass == 0 {
+			if inClass != 0 {
+				regex += "*"
+			} else if !path {
 				regex += ".*"
+			} else if i+1 < len(arr) && arr[i+1] == '*' {
+				// globstar
+				i++
+				if i+1 < len(arr) && arr[i+1] == '/' && (i == 1 || arr[i-2] == '/') {
+					// zero or more folders
+					i++
+					regex += "(.*/)?"
+				} else {
+					regex += ".*"
+				}
 			} else {
-				regex += "*"
+				regex += "[^/]*"
 			}
 		case '?':
 			if inClass == 0 {
-				regex += "."
+				if path {
+					regex += "[^/]"
+				} else {
+					regex += "."
+				}
 			} else {
 				regex += "?"
 			}
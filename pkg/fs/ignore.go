@@ -0,0 +1,189 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is the name of the files with patterns of paths to skip,
+// using the same syntax as .gitignore
+const IgnoreFile = ".confinitignore"
+
+// IgnorePattern is a line of an ignore file
+type IgnorePattern struct {
+	Pattern string
+	Negate  bool
+	DirOnly bool
+	regex   *regexp.Regexp
+}
+
+// Ignore are the patterns of an ignore file, which apply to the
+// folder Base (relative to the source) and its subfolders
+type Ignore struct {
+	File     string
+	Base     string
+	Patterns []*IgnorePattern
+}
+
+// ReadIgnore loads the patterns of the ignore file p for the folder base
+func ReadIgnore(p, base string) (*Ignore, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ign := Ignore{
+		File: p,
+		Base: base,
+	}
+	s := bufio.NewScanner(f)
+	n := 0
+	for s.Scan() {
+		n++
+		pattern, err := NewIgnorePattern(s.Text())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern in '%s' line %d, %s", p, n, err)
+		}
+		if pattern != nil {
+			ign.Patterns = append(ign.Patterns, pattern)
+		}
+	}
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot read '%s', %s", p, err)
+	}
+	return &ign, nil
+}
+
+// NewIgnorePattern parses a line of an ignore file, returns nil for
+// empty lines and comments
+func NewIgnorePattern(line string) (*IgnorePattern, error) {
+	line = strings.TrimRight(line, "\r")
+	// trailing spaces are ignored unless they are escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	p := IgnorePattern{Pattern: line}
+	if strings.HasPrefix(line, "!") {
+		p.Negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.DirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+	// A separator at the beginning or in the middle anchors the pattern
+	// to the folder of the ignore file, otherwise it matches at any level
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	regex := ignoreToRegex(line)
+	if !anchored {
+		regex = "(.*/)?" + regex
+	}
+	r, err := regexp.Compile("^" + regex + "$")
+	if err != nil {
+		return nil, err
+	}
+	p.regex = r
+	return &p, nil
+}
+
+func ignoreToRegex(pattern string) string {
+	regex := ""
+	for i := 0; i < len(pattern); i++ {
+		rest := pattern[i:]
+		switch {
+		case strings.HasPrefix(rest, "**/") && (i == 0 || pattern[i-1] == '/'):
+			// zero or more folders
+			regex += "(.*/)?"
+			i += 2
+		case rest == "**" && (i == 0 || pattern[i-1] == '/'):
+			// everything inside
+			regex += ".*"
+			i++
+		case rest[0] == '*':
+			regex += "[^/]*"
+		case rest[0] == '?':
+			regex += "[^/]"
+		case rest[0] == '\\' && len(rest) > 1:
+			regex += regexp.QuoteMeta(rest[1:2])
+			i++
+		case rest[0] == '[':
+			end := strings.Index(rest[1:], "]")
+			if end < 0 {
+				regex += "\\["
+				continue
+			}
+			class := rest[1 : end+1]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			regex += "[" + strings.Replace(class, "\\", "\\\\", -1) + "]"
+			i += end + 1
+		default:
+			regex += regexp.QuoteMeta(rest[0:1])
+		}
+	}
+	return regex
+}
+
+// Match returns true if the pattern matches the path p, relative to
+// the folder of the ignore file
+func (ip *IgnorePattern) Match(p string, dir bool) bool {
+	if ip.DirOnly && !dir {
+		return false
+	}
+	return ip.regex.MatchString(filepath.ToSlash(p))
+}
+
+// Ignored evaluates the path p (relative to the source) with the list of
+// ignore files, from top to bottom. The last pattern matching decides.
+func Ignored(ignores []*Ignore, p string, dir bool) (bool, *IgnorePattern) {
+	ignored := false
+	var last *IgnorePattern
+	for _, ign := range ignores {
+		rel := p
+		if ign.Base != "." {
+			if !strings.HasPrefix(p, ign.Base+string(filepath.Separator)) {
+				continue
+			}
+			rel = strings.TrimPrefix(p, ign.Base+string(filepath.Separator))
+		}
+		for _, pattern := range ign.Patterns {
+			if pattern.Match(rel, dir) {
+				ignored = !pattern.Negate
+				last = pattern
+			}
+		}
+	}
+	return ignored, last
+}
+
+func (ip *IgnorePattern) String() string {
+	return ip.Pattern
+}
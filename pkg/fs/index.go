@@ -0,0 +1,108 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// IndexFile is the default name of the scan index
+const IndexFile = "index.json"
+
+// IndexEntry describes a scanned path, if one of the fields changes
+// between runs the path is considered changed
+type IndexEntry struct {
+	Size    int64       `json:"size"`
+	ModTime int64       `json:"mtime"`
+	Inode   uint64      `json:"inode"`
+	Mode    os.FileMode `json:"mode"`
+}
+
+// Index is the list of paths scanned in the previous and in the current
+// run, shared by all the Fs scanning sources in the same run
+type Index struct {
+	Entries  map[string]*IndexEntry `json:"entries"`
+	previous map[string]*IndexEntry
+	path     string
+	mutex    sync.Mutex
+}
+
+func NewIndex(p string) *Index {
+	return &Index{
+		Entries:  make(map[string]*IndexEntry),
+		previous: make(map[string]*IndexEntry),
+		path:     p,
+	}
+}
+
+// LoadIndex reads the index of the previous run, if the file does not
+// exist the index is empty (everything is changed)
+func LoadIndex(p string) (*Index, error) {
+	idx := NewIndex(p)
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return idx, nil
+		}
+		return idx, fmt.Errorf("Cannot read scan index '%s', %s", p, err)
+	}
+	prev := Index{}
+	if err = json.Unmarshal(content, &prev); err != nil {
+		return idx, fmt.Errorf("Invalid scan index '%s', %s", p, err)
+	}
+	if prev.Entries != nil {
+		idx.previous = prev.Entries
+	}
+	return idx, nil
+}
+
+// Save writes the paths scanned in this run
+func (idx *Index) Save() error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(idx.path), 0755); err != nil {
+		return err
+	}
+	content, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	tmp := idx.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("Cannot write scan index '%s', %s", tmp, err)
+	}
+	return os.Rename(tmp, idx.path)
+}
+
+// Update records the path p and returns true if it is new or it changed
+// since the previous run
+func (idx *Index) Update(p string, fi os.FileInfo) bool {
+	e := &IndexEntry{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Inode:   inode(fi),
+		Mode:    fi.Mode(),
+	}
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.Entries[p] = e
+	prev, ok := idx.previous[p]
+	return !ok || *prev != *e
+}
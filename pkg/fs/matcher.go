@@ -0,0 +1,178 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "confinit/pkg/log"
+)
+
+const (
+	// DefaultContentSize is how much of the files is read to match
+	// their content
+	DefaultContentSize = 64 * 1024
+	// sniffSize is the maximum read by http.DetectContentType
+	sniffSize = 512
+)
+
+// Matcher selects files by their metadata and content, the fields not
+// defined match all files. Links are matched by their target.
+type Matcher struct {
+	// MinSize and MaxSize in bytes, MaxSize 0 has no limit
+	MinSize int64
+	MaxSize int64
+	// Mode are permission bits which must be set
+	Mode os.FileMode
+	// Executable matches files with (or without) any executable bit
+	Executable *bool
+	// Content is matched with the first ContentSize bytes
+	Content     *regexp.Regexp
+	ContentSize int64
+	// Shebang matches files starting (or not) with "#!"
+	Shebang *bool
+	// Mime are prefixes of the type sniffed with http.DetectContentType,
+	// like "text/" or "application/octet-stream"
+	Mime []string
+}
+
+// NewMatcher returns a matcher which matches all files
+func NewMatcher() *Matcher {
+	return &Matcher{
+		ContentSize: DefaultContentSize,
+	}
+}
+
+// SetContent defines the regular expression for the first size bytes
+// of the files, 0 is the default size
+func (m *Matcher) SetContent(regex string, size int64) error {
+	if size > 0 {
+		m.ContentSize = size
+	}
+	if regex == "" {
+		m.Content = nil
+		return nil
+	}
+	pattern, err := regexp.Compile(regex)
+	if err != nil {
+		return fmt.Errorf("Invalid content pattern '%s', %s", regex, err)
+	}
+	m.Content = pattern
+	return nil
+}
+
+// head returns true if the matcher needs to read the files
+func (m *Matcher) head() bool {
+	return m.Content != nil || m.Shebang != nil || len(m.Mime) > 0
+}
+
+// Match returns true if the file p matches, errors reading it are
+// returned
+func (m *Matcher) Match(p string) (bool, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false, err
+	}
+	if fi.IsDir() {
+		return true, nil
+	}
+	if fi.Size() < m.MinSize || (m.MaxSize > 0 && fi.Size() > m.MaxSize) {
+		return false, nil
+	}
+	perm := fi.Mode().Perm() | (fi.Mode() & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky))
+	if perm&m.Mode != m.Mode {
+		return false, nil
+	}
+	if m.Executable != nil && (fi.Mode().Perm()&0111 != 0) != *m.Executable {
+		return false, nil
+	}
+	if !m.head() {
+		return true, nil
+	}
+	size := m.ContentSize
+	if size < sniffSize {
+		size = sniffSize
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, size)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	buf = buf[:n]
+	if m.Shebang != nil && bytes.HasPrefix(buf, []byte("#!")) != *m.Shebang {
+		return false, nil
+	}
+	if len(m.Mime) > 0 {
+		sniff := buf
+		if len(sniff) > sniffSize {
+			sniff = sniff[:sniffSize]
+		}
+		mime := http.DetectContentType(sniff)
+		found := false
+		for _, prefix := range m.Mime {
+			if strings.HasPrefix(mime, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Debugf("Type %s of %s does not match %v", mime, p, m.Mime)
+			return false, nil
+		}
+	}
+	if m.Content != nil {
+		if int64(len(buf)) > m.ContentSize {
+			buf = buf[:m.ContentSize]
+		}
+		if !m.Content.Match(buf) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// SetMatcher makes the processor select the files with m too, folders
+// are only selected by their path
+func (p *Processor) SetMatcher(m *Matcher) {
+	p.Matcher = m
+}
+
+// matchItem applies the matcher of the processor to the item
+func (p *Processor) matchItem(item *Item) bool {
+	if p.Matcher == nil || item.Mode.IsDir() {
+		return true
+	}
+	ok, err := p.Matcher.Match(filepath.Join(item.Base, item.Path))
+	if err != nil {
+		log.Errorf("Cannot match file %s, %s", item.Path, err)
+		return false
+	}
+	if !ok {
+		log.Debugf("Skipping file not selected by the matches: %s", item.Path)
+	}
+	return ok
+}
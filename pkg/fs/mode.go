@@ -0,0 +1,214 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	modeSetuid = 04000
+	modeSetgid = 02000
+	modeSticky = 01000
+)
+
+// modeOp is an operator of a symbolic mode clause with its permissions
+// (like "+rw") or the permissions to copy from u, g or o (like "=u")
+type modeOp struct {
+	op    byte
+	perms string
+	copy  byte
+}
+
+type modeClause struct {
+	who string
+	ops []modeOp
+}
+
+// ModeSpec is a mode in octal ("0644") or chmod symbolic ("u=rw,go=r",
+// "a+X") form. Symbolic modes are applied relative to a current mode.
+type ModeSpec struct {
+	Text    string
+	octal   uint32
+	clauses []modeClause
+}
+
+// ParseMode parses an octal or symbolic mode, an empty one or "0" means
+// not changing the mode and returns nil
+func ParseMode(s string) (*ModeSpec, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if s[0] >= '0' && s[0] <= '9' {
+		mode, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || mode > 07777 {
+			return nil, fmt.Errorf("Invalid mode '%s'", s)
+		}
+		if mode == 0 {
+			return nil, nil
+		}
+		return &ModeSpec{Text: s, octal: uint32(mode)}, nil
+	}
+	m := ModeSpec{Text: s}
+	for _, part := range strings.Split(s, ",") {
+		c := modeClause{}
+		i := 0
+		for i < len(part) && strings.IndexByte("ugoa", part[i]) >= 0 {
+			i++
+		}
+		c.who = part[:i]
+		if i == len(part) {
+			return nil, fmt.Errorf("Invalid mode '%s', missing operator in '%s'", s, part)
+		}
+		for i < len(part) {
+			op := modeOp{op: part[i]}
+			if strings.IndexByte("+-=", op.op) < 0 {
+				return nil, fmt.Errorf("Invalid mode '%s', unknown operator '%c'", s, op.op)
+			}
+			i++
+			j := i
+			for j < len(part) && strings.IndexByte("+-=", part[j]) < 0 {
+				j++
+			}
+			perms := part[i:j]
+			switch {
+			case len(perms) == 1 && strings.IndexByte("ugo", perms[0]) >= 0:
+				op.copy = perms[0]
+			case strings.Trim(perms, "rwxXst") == "":
+				op.perms = perms
+			default:
+				return nil, fmt.Errorf("Invalid mode '%s', unknown permissions '%s'", s, perms)
+			}
+			c.ops = append(c.ops, op)
+			i = j
+		}
+		m.clauses = append(m.clauses, c)
+	}
+	return &m, nil
+}
+
+// Symbolic returns true if the mode depends on the current one
+func (m *ModeSpec) Symbolic() bool {
+	return m != nil && len(m.clauses) > 0
+}
+
+// Apply returns the mode resulting of applying m to the current mode
+// of a file or a folder (dir)
+func (m *ModeSpec) Apply(current os.FileMode, dir bool) os.FileMode {
+	if m == nil {
+		return current
+	}
+	if !m.Symbolic() {
+		return FromUnixMode(m.octal)
+	}
+	mode := ToUnixMode(current)
+	for _, c := range m.clauses {
+		rwx, special := whoMasks(c.who)
+		for _, op := range c.ops {
+			var bits uint32
+			if op.copy != 0 {
+				shift := map[byte]uint{'u': 6, 'g': 3, 'o': 0}[op.copy]
+				v := (mode >> shift) & 7
+				bits = (v<<6 | v<<3 | v) & rwx
+			}
+			for _, p := range op.perms {
+				switch p {
+				case 'r':
+					bits |= 0444 & rwx
+				case 'w':
+					bits |= 0222 & rwx
+				case 'x':
+					bits |= 0111 & rwx
+				case 'X':
+					if dir || mode&0111 != 0 {
+						bits |= 0111 & rwx
+					}
+				case 's', 't':
+					bits |= special & map[rune]uint32{'s': modeSetuid | modeSetgid, 't': modeSticky}[p]
+				}
+			}
+			switch op.op {
+			case '+':
+				mode |= bits
+			case '-':
+				mode &^= bits
+			case '=':
+				mode = mode&^(rwx|special) | bits
+			}
+		}
+	}
+	return FromUnixMode(mode)
+}
+
+// whoMasks returns the permission and special bits affected by the users
+// of a clause (all without users)
+func whoMasks(who string) (rwx, special uint32) {
+	if who == "" || strings.Contains(who, "a") {
+		return 0777, modeSetuid | modeSetgid | modeSticky
+	}
+	for _, w := range who {
+		switch w {
+		case 'u':
+			rwx, special = rwx|0700, special|modeSetuid
+		case 'g':
+			rwx, special = rwx|0070, special|modeSetgid
+		case 'o':
+			rwx, special = rwx|0007, special|modeSticky
+		}
+	}
+	return
+}
+
+// ToUnixMode returns the permission and special bits of mode in the unix
+// numeric format
+func ToUnixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= modeSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= modeSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= modeSticky
+	}
+	return m
+}
+
+// FromUnixMode converts a unix numeric mode (like 04755) in os.FileMode
+func FromUnixMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m&modeSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&modeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&modeSticky != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func (m *ModeSpec) String() string {
+	if m == nil {
+		return "-"
+	}
+	return m.Text
+}
@@ -0,0 +1,109 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// OrderLexical sorts paths by bytes, like run-parts or ls
+	OrderLexical = "lexical"
+	// OrderNatural sorts numbers in paths by value: 2-b before 10-a
+	OrderNatural = "natural"
+)
+
+// runPartsName are the names allowed by run-parts (without --lsbsysinit)
+var runPartsName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// RunParts returns false if the file p (with mode) would be skipped by
+// run-parts: names with dots (like backups or package manager files) or
+// other characters and files not executable
+func RunParts(p string, mode os.FileMode) bool {
+	if !runPartsName.MatchString(filepath.Base(p)) {
+		return false
+	}
+	if mode&os.ModeSymlink != 0 {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return false
+		}
+		mode = fi.Mode()
+	}
+	return mode.IsRegular() && mode.Perm()&0111 != 0
+}
+
+// SortPaths sorts the list of paths folder by folder, so folders are
+// always before their contents
+func SortPaths(paths []string, order string) {
+	natural := order == OrderNatural
+	sep := string(filepath.Separator)
+	sort.SliceStable(paths, func(i, j int) bool {
+		a := strings.Split(paths[i], sep)
+		b := strings.Split(paths[j], sep)
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] == b[k] {
+				continue
+			}
+			if natural {
+				return naturalLess(a[k], b[k])
+			}
+			return a[k] < b[k]
+		}
+		return len(a) < len(b)
+	})
+}
+
+// naturalLess compares the strings by chunks, numbers by their value
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		na, ra := chunk(a)
+		nb, rb := chunk(b)
+		da, db := isDigit(na[0]), isDigit(nb[0])
+		switch {
+		case da && db:
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) < len(tb)
+			}
+			if ta != tb {
+				return ta < tb
+			}
+		case na != nb:
+			return na < nb
+		}
+		a, b = ra, rb
+	}
+	return len(a) < len(b)
+}
+
+// chunk returns the first sequence of digits or non digits of s and
+// the rest
+func chunk(s string) (string, string) {
+	digit := isDigit(s[0])
+	i := 1
+	for i < len(s) && isDigit(s[i]) == digit {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -18,15 +18,58 @@ import (
 	"fmt"
 	"os"
 	"os/user"
+	"sort"
 	"strconv"
+	"sync"
+
+	log "confinit/pkg/log"
 )
 
+// Perm are the owners, mode and attributes to set to paths. Users and
+// groups are resolved when they are set (they can be created by previous
+// steps), if they do not exist the uid and gid fallbacks are used (if
+// they are not negative).
 type Perm struct {
-	User  int
-	Group int
-	Mode  os.FileMode
+	User         int
+	Group        int
+	UserName     string
+	GroupName    string
+	UidFallback  int
+	GidFallback  int
+	Mode         os.FileMode
+	Spec         *ModeSpec
+	Xattrs       map[string]string
+	Capabilities string
+	caps         []byte
+	mutex        sync.Mutex
+}
+
+// LookupUser returns the uid of a user name or id
+func LookupUser(uid string) (int, error) {
+	u, err := user.LookupId(uid)
+	if err != nil {
+		u, err = user.Lookup(uid)
+		if err != nil {
+			return -1, fmt.Errorf("Invalid %s", err)
+		}
+	}
+	return strconv.Atoi(u.Uid)
 }
 
+// LookupGroup returns the gid of a group name or id
+func LookupGroup(gid string) (int, error) {
+	g, err := user.LookupGroupId(gid)
+	if err != nil {
+		g, err = user.LookupGroup(gid)
+		if err != nil {
+			return -1, fmt.Errorf("Invalid %s", err)
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// NewPerm defines the owners (the current user and group if they are
+// empty) and mode, owners are resolved later by Set
 func NewPerm(uid, gid string, mode os.FileMode) (*Perm, error) {
 	currentUser, err := user.Current()
 	if err != nil {
@@ -36,52 +79,148 @@ func NewPerm(uid, gid string, mode os.FileMode) (*Perm, error) {
 	userID, _ := strconv.Atoi(currentUser.Uid)
 	groupID, _ := strconv.Atoi(currentUser.Gid)
 	if uid != "" {
-		u, erru := user.LookupId(uid)
-		if erru != nil {
-			u, erru = user.Lookup(uid)
-			if erru != nil {
-				erru = fmt.Errorf("Invalid %s", erru)
-				return nil, erru
-			}
-		}
-		userID, _ = strconv.Atoi(u.Uid)
+		userID = -1
 	}
 	if gid != "" {
-		g, errg := user.LookupGroupId(gid)
-		if errg != nil {
-			g, errg = user.LookupGroup(gid)
-			if errg != nil {
-				errg = fmt.Errorf("Invalid %s", errg)
-				return nil, errg
-			}
-		}
-		groupID, _ = strconv.Atoi(g.Gid)
+		groupID = -1
 	}
 	p := Perm{
-		User:  userID,
-		Group: groupID,
-		Mode:  mode,
+		User:        userID,
+		Group:       groupID,
+		UserName:    uid,
+		GroupName:   gid,
+		UidFallback: -1,
+		GidFallback: -1,
+		Mode:        mode,
 	}
 	return &p, nil
 }
 
+// SetFallback defines the uid and gid used when the user or the group
+// do not exist, negative values mean no fallback
+func (p *Perm) SetFallback(uid, gid int) {
+	p.UidFallback = uid
+	p.GidFallback = gid
+}
+
+// owners resolves the user and the group, only found ones are cached
+func (p *Perm) owners() (int, int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	uid, gid := p.User, p.Group
+	var err error
+	if uid < 0 {
+		if uid, err = LookupUser(p.UserName); err == nil {
+			p.User = uid
+		} else if p.UidFallback >= 0 {
+			log.Warnf("User '%s' not found, using uid %d", p.UserName, p.UidFallback)
+			uid = p.UidFallback
+		} else {
+			return -1, -1, err
+		}
+	}
+	if gid < 0 {
+		if gid, err = LookupGroup(p.GroupName); err == nil {
+			p.Group = gid
+		} else if p.GidFallback >= 0 {
+			log.Warnf("Group '%s' not found, using gid %d", p.GroupName, p.GidFallback)
+			gid = p.GidFallback
+		} else {
+			return -1, -1, err
+		}
+	}
+	return uid, gid, nil
+}
+
+// SetMode defines the mode in octal or symbolic form, symbolic modes are
+// applied relative to the current mode of the path
+func (p *Perm) SetMode(text string) error {
+	spec, err := ParseMode(text)
+	if err != nil {
+		return err
+	}
+	p.Spec = spec
+	return nil
+}
+
+// SetXattrs defines extended attributes (name and value) to set
+func (p *Perm) SetXattrs(attrs map[string]string) {
+	p.Xattrs = attrs
+}
+
+// SetCapabilities defines the file capabilities in textual form, like
+// "cap_net_bind_service+ep"
+func (p *Perm) SetCapabilities(text string) error {
+	if text == "" {
+		p.Capabilities, p.caps = "", nil
+		return nil
+	}
+	caps, err := ParseCapabilities(text)
+	if err != nil {
+		return err
+	}
+	p.Capabilities, p.caps = text, caps
+	return nil
+}
+
 func (p *Perm) String() string {
-	return fmt.Sprintf("%d:%d %s", p.User, p.Group, p.Mode.String())
+	owner, group := p.UserName, p.GroupName
+	if owner == "" {
+		owner = strconv.Itoa(p.User)
+	}
+	if group == "" {
+		group = strconv.Itoa(p.Group)
+	}
+	s := fmt.Sprintf("%s:%s %s", owner, group, p.Mode.String())
+	if p.Spec != nil {
+		s = fmt.Sprintf("%s:%s %s", owner, group, p.Spec)
+	}
+	if len(p.Xattrs) > 0 {
+		s += fmt.Sprintf(" xattrs=%v", p.Xattrs)
+	}
+	if p.Capabilities != "" {
+		s += fmt.Sprintf(" capabilities=%s", p.Capabilities)
+	}
+	return s
 }
 
 func (p *Perm) Set(fullp string) error {
-	var errd, errn error
-	if p.Mode != 0 {
-		errd = os.Chmod(fullp, p.Mode)
-		if errd != nil {
-			errd = fmt.Errorf("Cannot set mode (%s) to '%s': %s", p.Mode.String(), fullp, errd)
-			return errd
+	uid, gid, err := p.owners()
+	if err != nil {
+		return fmt.Errorf("Cannot set owners to '%s': %s", fullp, err)
+	}
+	// chown clears setuid and setgid bits, mode is set after it
+	if err := os.Chown(fullp, uid, gid); err != nil {
+		return fmt.Errorf("Cannot set owner (%d) and/or group (%d) to '%s': %s", uid, gid, fullp, err)
+	}
+	mode := p.Mode
+	if p.Spec != nil {
+		fi, err := os.Stat(fullp)
+		if err != nil {
+			return err
 		}
+		mode = p.Spec.Apply(fi.Mode(), fi.IsDir())
 	}
-	errn = os.Chown(fullp, p.User, p.Group)
-	if errn != nil {
-		errn = fmt.Errorf("Cannot set owner (%d) and/or group (%d) to '%s': %s", p.User, p.Group, fullp, errn)
-		return errn
+	if mode != 0 {
+		if err := os.Chmod(fullp, mode); err != nil {
+			return fmt.Errorf("Cannot set mode (%s) to '%s': %s", mode.String(), fullp, err)
+		}
+	}
+	// after chown, it also clears the capabilities
+	names := make([]string, 0, len(p.Xattrs))
+	for name := range p.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := SetXattr(fullp, name, []byte(p.Xattrs[name])); err != nil {
+			return err
+		}
+	}
+	if p.caps != nil {
+		if err := SetXattr(fullp, CapabilityXattr, p.caps); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -69,10 +69,10 @@ func NewPermissions(glob, uid, gid string, mode os.FileMode, typ FsItemType) (*P
 	return &p, nil
 }
 
-func (fp *Permissions) Function(base string, path string, i os.FileMode) error {
-	err := fp.perm.Set(filepath.Join(base, path))
+func (fp *Permissions) Function(item *Item) error {
+	err := fp.perm.Set(filepath.Join(item.Base, item.Path))
 	if err == nil {
-		log.Debugf("Successfully applied permissions to '%s'", filepath.Join(base, path))
+		log.Debugf("Successfully applied permissions to '%s'", filepath.Join(item.Base, item.Path))
 	}
 	return err
 }
@@ -18,6 +18,8 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
+	"sync"
 	"text/template"
 
 	log "confinit/pkg/log"
@@ -33,8 +35,8 @@ const (
 
 // Process is an interface to define a configurator factory
 type Process interface {
-	Function(base string, path string, i os.FileMode) error
-	Match(path string, i os.FileMode) bool
+	Function(item *Item) error
+	Match(item *Item) bool
 	AddProcessed(path string, i os.FileMode)
 	AddError(path string, err error)
 	Type(t FsItemType) bool
@@ -44,36 +46,72 @@ type Process interface {
 	ListMapProcessed() map[string]os.FileMode
 }
 
+// sorted returns the paths of m in the order of the Fs
+func (fs *Fs) sorted(m MapFile) []string {
+	paths := make([]string, 0, len(m))
+	for p := range m {
+		paths = append(paths, p)
+	}
+	SortPaths(paths, fs.Order)
+	return paths
+}
+
+// Parallel is implemented by the processes which define how many items
+// can be processed at the same time (0 means the Fs default)
+type Parallel interface {
+	MaxParallel() int
+}
+
+// Sequential is implemented by the processes which decide per item if
+// it has to be processed alone, once the previous items are done
+type Sequential interface {
+	Sequential(item *Item) bool
+}
+
+// Run calls the process with the folders (if its type allows them) and
+// then with the files, in order. Folders are always processed one by one,
+// files by a pool of workers (see Workers option and Parallel interface),
+// but results and errors are always aggregated in the same order.
 func (fs *Fs) Run(f Process) error {
 	e := false
+	workers := fs.Workers
+	if p, ok := f.(Parallel); ok && p.MaxParallel() > 0 {
+		workers = p.MaxParallel()
+	}
 	if f.Type(FsItemAll) || f.Type(FsItemDir) {
-		for dir := range fs.dirs {
-			if f.Match(dir, fs.dirs[dir]) {
-				if err := f.Function(fs.BasePath, dir, fs.dirs[dir]); err != nil {
+		for _, dir := range fs.sorted(fs.dirs) {
+			item := fs.dirs[dir]
+			if f.Match(item) {
+				if err := f.Function(item); err != nil {
 					f.AddError(dir, err)
 					log.Errorf("Could not complete process with folder '%s': %s", dir, err)
 					e = true
 				}
-				f.AddProcessed(dir, fs.dirs[dir])
+				f.AddProcessed(dir, item.Mode)
 			}
 		}
 	}
 	if f.Type(FsItemAll) || f.Type(FsItemFile) {
-		for archive := range fs.files {
-			if f.Match(archive, fs.files[archive]) {
-				if err := f.Function(fs.BasePath, archive, fs.files[archive]); err != nil {
-					switch err.(type) {
-					case template.ExecError:
-						// Errors comning from templates have a good description
-						log.Errorf("Failing %s", err)
-					default:
-						log.Errorf("Could not complete process with file '%s': %s", archive, err)
-					}
-					f.AddError(archive, err)
-					e = true
+		var items []*Item
+		for _, archive := range fs.sorted(fs.files) {
+			if item := fs.files[archive]; f.Match(item) {
+				items = append(items, item)
+			}
+		}
+		errs := runItems(f, items, workers)
+		for i, item := range items {
+			if err := errs[i]; err != nil {
+				switch err.(type) {
+				case template.ExecError:
+					// Errors comning from templates have a good description
+					log.Errorf("Failing %s", err)
+				default:
+					log.Errorf("Could not complete process with file '%s': %s", item.Path, err)
 				}
-				f.AddProcessed(archive, fs.dirs[archive])
+				f.AddError(item.Path, err)
+				e = true
 			}
+			f.AddProcessed(item.Path, item.Mode)
 		}
 	}
 	if e {
@@ -82,14 +120,63 @@ func (fs *Fs) Run(f Process) error {
 	return nil
 }
 
+// runItems calls the process function with each item using a pool of
+// workers, the errors are returned in the same order as the items.
+// Sequential items wait for the previous ones and run alone.
+func runItems(f Process, items []*Item, workers int) []error {
+	errs := make([]error, len(items))
+	if workers <= 1 {
+		for i, item := range items {
+			errs[i] = f.Function(item)
+		}
+		return errs
+	}
+	start := 0
+	if s, ok := f.(Sequential); ok {
+		for i, item := range items {
+			if s.Sequential(item) {
+				runPool(f, items[start:i], errs[start:i], workers)
+				errs[i] = f.Function(item)
+				start = i + 1
+			}
+		}
+	}
+	runPool(f, items[start:], errs[start:], workers)
+	return errs
+}
+
+// runPool calls the process function with the items using a pool of
+// workers, errs gets the error of each item
+func runPool(f Process, items []*Item, errs []error, workers int) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(items); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = f.Function(items[i])
+			}
+		}()
+	}
+	for i := range items {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
 //
 
 // Processor implments Process interface and is the base class for all its subclasses
 // defined in actions package
 type Processor struct {
 	Regex     *regexp.Regexp
+	Globs     Globs
+	Matcher   *Matcher
 	FsType    FsItemType
 	Exclude   []string
+	excluded  map[string]bool
 	Processed map[string]os.FileMode
 	Errors    map[string]error
 }
@@ -105,8 +192,12 @@ func NewProcessor(regex string, t FsItemType, exclude []string) (*Processor, err
 		Processed: make(map[string]os.FileMode),
 		Errors:    make(map[string]error),
 		Exclude:   exclude,
+		excluded:  make(map[string]bool, len(exclude)),
 		FsType:    t,
 	}
+	for _, exc := range exclude {
+		p.excluded[exc] = true
+	}
 	return &p, nil
 }
 
@@ -114,13 +205,24 @@ func (p *Processor) Type(t FsItemType) bool {
 	return p.FsType == t
 }
 
-func (p *Processor) Match(path string, i os.FileMode) bool {
-	for _, exc := range p.Exclude {
-		if exc == path {
+func (p *Processor) Match(item *Item) bool {
+	if p.excluded[item.Path] {
+		return false
+	}
+	if len(p.Globs) > 0 {
+		if !p.Globs.MatchString(item.Path) {
 			return false
 		}
+	} else if !p.Regex.MatchString(item.Path) {
+		return false
 	}
-	return p.Regex.MatchString(path)
+	return p.matchItem(item)
+}
+
+// SetGlobs makes the processor match items with the globs instead of
+// the regular expression
+func (p *Processor) SetGlobs(globs Globs) {
+	p.Globs = globs
 }
 
 func (p *Processor) AddProcessed(path string, i os.FileMode) {
@@ -136,6 +238,7 @@ func (p *Processor) ListErrors() []string {
 	for k := range p.Errors {
 		v = append(v, k)
 	}
+	sort.Strings(v)
 	return v
 }
 
@@ -144,6 +247,7 @@ func (p *Processor) ListProcessed() []string {
 	for k := range p.Processed {
 		v = append(v, k)
 	}
+	sort.Strings(v)
 	return v
 }
 
@@ -155,6 +259,6 @@ func (p *Processor) ListMapProcessed() map[string]os.FileMode {
 	return p.Processed
 }
 
-func (p *Processor) Function(base string, path string, i os.FileMode) error {
+func (p *Processor) Function(item *Item) error {
 	return nil
 }
@@ -0,0 +1,37 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// excludedItems returns n items and the paths of half of them, like
+// the files processed by a previous operation
+func excludedItems(n int) ([]*Item, []string) {
+	items := make([]*Item, n)
+	excludes := []string{}
+	for i := range items {
+		items[i] = &Item{
+			Path: fmt.Sprintf("d%03d/f%05d.conf", i/100, i),
+			Mode: os.FileMode(0644),
+		}
+		if i%2 == 0 {
+			excludes = append(excludes, items[i].Path)
+		}
+	}
+	return items, excludes
+}
+
+func TestMatchExcludes(t *testing.T) {
+	items, excludes := excludedItems(10)
+	p, err := NewProcessor(".*", FsItemAll, excludes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range items {
+		if p.Match(item) != (i%2 != 0) {
+			t.Errorf("Unexpected match of %s", item.Path)
+		}
+	}
+}
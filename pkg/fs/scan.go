@@ -20,17 +20,201 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	log "confinit/pkg/log"
 )
 
+const (
+	// WhiteoutPrefix marks a file which deletes the same name in lower layers
+	WhiteoutPrefix = ".wh."
+	// WhiteoutOpaque marks a folder which hides the contents of lower layers
+	WhiteoutOpaque = ".wh..wh..opq"
+)
+
 func (fs *Fs) Scan(p string) error {
+	return fs.ScanLayers([]string{p})
+}
+
+// ScanLayers scans a list of folders merging them like an overlayfs, later
+// layers win for the same relative path and whiteout files delete paths
+// from lower layers
+func (fs *Fs) ScanLayers(layers []string) error {
 	fs.skippedPaths = nil
 	fs.skippedFiles = nil
 	fs.files = make(MapFile)
 	fs.dirs = make(MapFile)
-	fs.BasePath = p
-	return filepath.Walk(fs.BasePath, fs.scan)
+	fs.configs = make(map[string]*DirConfig)
+	fs.ignores = make(map[string]*Ignore)
+	fs.changed = make(map[string]bool)
+	fs.Layers = layers
+	for i, layer := range layers {
+		fs.layer = i
+		fs.BasePath = layer
+		if err := filepath.Walk(layer, fs.scan); err != nil {
+			return err
+		}
+	}
+	if len(layers) > 0 {
+		fs.BasePath = layers[0]
+	}
+	fs.applyIgnores()
+	fs.applyConfigs()
+	return nil
+}
+
+// ignoreList returns the ignore files which apply to the path p, from
+// top to bottom
+func (fs *Fs) ignoreList(p string) []*Ignore {
+	var list []*Ignore
+	if fs.Ignore != nil {
+		list = append(list, fs.Ignore)
+	}
+	if ign, ok := fs.ignores["."]; ok {
+		list = append(list, ign)
+	}
+	dir := ""
+	parts := strings.Split(p, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		if ign, ok := fs.ignores[dir]; ok {
+			list = append(list, ign)
+		}
+	}
+	return list
+}
+
+// ignored returns true if the path p is excluded by the ignore files
+func (fs *Fs) ignored(p string, dir bool) bool {
+	if p == "." {
+		return false
+	}
+	if ignored, pattern := Ignored(fs.ignoreList(p), p, dir); ignored {
+		log.Debugf("Ignoring path due to pattern '%s': %s", pattern, p)
+		return true
+	}
+	return false
+}
+
+// applyIgnores removes the items of lower layers ignored by the ignore
+// files of upper layers
+func (fs *Fs) applyIgnores() {
+	if len(fs.Layers) < 2 {
+		return
+	}
+	for _, relp := range fs.ListDirs() {
+		// parents are always before their subfolders
+		if _, ok := fs.dirs[filepath.Dir(relp)]; (!ok && relp != ".") || fs.ignored(relp, true) {
+			fs.skippedPaths = append(fs.skippedPaths, relp)
+			delete(fs.dirs, relp)
+		}
+	}
+	for _, relp := range fs.ListFiles() {
+		if _, ok := fs.dirs[filepath.Dir(relp)]; (!ok && filepath.Dir(relp) != ".") || fs.ignored(relp, false) {
+			fs.skippedFiles = append(fs.skippedFiles, relp)
+			delete(fs.files, relp)
+		}
+	}
+}
+
+// applyConfigs merges the folder configurations from top to bottom,
+// assigns the effective one to each item and removes the items not
+// allowed by them
+func (fs *Fs) applyConfigs() {
+	if len(fs.configs) == 0 {
+		return
+	}
+	effective := make(map[string]*DirConfig)
+	var get func(d string) *DirConfig
+	get = func(d string) *DirConfig {
+		if c, ok := effective[d]; ok {
+			return c
+		}
+		var parent *DirConfig
+		if d != "." {
+			parent = get(filepath.Dir(d))
+		}
+		c := parent.Merge(fs.configs[d])
+		effective[d] = c
+		return c
+	}
+	for _, relp := range fs.ListDirs() {
+		item := fs.dirs[relp]
+		if item.Config = get(relp); item.Config == nil {
+			continue
+		}
+		item.Changed = item.Changed || fs.configChanged(item.Config)
+		if ok, reason := item.Config.Allowed(relp, true); !ok {
+			fs.skippedPaths = append(fs.skippedPaths, relp)
+			log.Debugf("Skipping folder due to %s: %s", reason, relp)
+			delete(fs.dirs, relp)
+			continue
+		}
+		log.Debugf("Effective settings for folder '%s': %s", relp, item.Config.Describe(relp, true))
+	}
+	for _, relp := range fs.ListFiles() {
+		item := fs.files[relp]
+		if item.Config = get(filepath.Dir(relp)); item.Config == nil {
+			continue
+		}
+		item.Changed = item.Changed || fs.configChanged(item.Config)
+		if ok, reason := item.Config.Allowed(relp, false); !ok {
+			fs.skippedFiles = append(fs.skippedFiles, relp)
+			log.Debugf("Skipping file due to %s: %s", reason, relp)
+			delete(fs.files, relp)
+			continue
+		}
+		log.Debugf("Effective settings for file '%s': %s", relp, item.Config.Describe(relp, false))
+	}
+}
+
+// configChanged returns true if one of the files of the configuration
+// changed since the previous run
+func (fs *Fs) configChanged(c *DirConfig) bool {
+	for _, f := range c.Files {
+		if fs.changed[f] {
+			return true
+		}
+	}
+	return false
+}
+
+// update records the path p in the index and returns true if it is new
+// or changed, without index everything is changed
+func (fs *Fs) update(p string, i os.FileInfo) bool {
+	if fs.Index == nil {
+		return true
+	}
+	abspath := p
+	if !filepath.IsAbs(p) {
+		abspath = filepath.Join(fs.CurrentPath, p)
+	}
+	return fs.Index.Update(abspath, i)
+}
+
+// whiteout removes relp (and its contents) coming from lower layers
+func (fs *Fs) whiteout(relp string, opaque bool) {
+	prefix := relp + string(filepath.Separator)
+	if opaque {
+		prefix = filepath.Dir(relp) + string(filepath.Separator)
+		if filepath.Dir(relp) == "." {
+			prefix = ""
+		}
+	}
+	if !opaque && filepath.Base(relp) == DirConfigFile {
+		delete(fs.configs, filepath.Dir(relp))
+	}
+	if !opaque && filepath.Base(relp) == IgnoreFile {
+		delete(fs.ignores, filepath.Dir(relp))
+	}
+	for _, m := range []MapFile{fs.dirs, fs.files} {
+		for p, item := range m {
+			if item.Layer < fs.layer && ((!opaque && p == relp) || strings.HasPrefix(p, prefix)) {
+				log.Debugf("Whiteout in layer %s: %s", fs.BasePath, p)
+				delete(m, p)
+			}
+		}
+	}
 }
 
 func (fs *Fs) scan(p string, i os.FileInfo, err error) error {
@@ -43,30 +227,81 @@ func (fs *Fs) scan(p string, i os.FileInfo, err error) error {
 	if err != nil {
 		return err
 	}
+	item := &Item{
+		Path:  relp,
+		Base:  fs.BasePath,
+		Layer: fs.layer,
+		Mode:  i.Mode(),
+		Stat:  NewStat(i),
+	}
+	if i.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Stat(p); err == nil {
+			item.Stat = NewStat(target)
+		}
+	}
+	item.Changed = fs.update(p, i)
 	if i.IsDir() {
-		if fs.SkipDirGlob != nil && fs.SkipDirGlob.MatchString(relp) {
+		if fs.SkipDirGlob.MatchString(relp) {
 			fs.skippedPaths = append(fs.skippedPaths, relp)
 			log.Debugf("Skipping folder due to glob '%s': %s", fs.SkipDirGlob.String(), relp)
 			return filepath.SkipDir
-		} else if fs.DirGlob != nil && !fs.DirGlob.MatchString(relp) {
+		} else if len(fs.DirGlob) > 0 && !fs.DirGlob.MatchString(relp) {
 			fs.skippedPaths = append(fs.skippedPaths, relp)
 			log.Debugf("Skipping folder due to not matching glob '%s': %s", fs.DirGlob.String(), relp)
 			return filepath.SkipDir
 		}
+		if fs.ignored(relp, true) {
+			fs.skippedPaths = append(fs.skippedPaths, relp)
+			return filepath.SkipDir
+		}
+		ign := filepath.Join(p, IgnoreFile)
+		if _, err := os.Stat(ign); err == nil {
+			patterns, err := ReadIgnore(ign, relp)
+			if err != nil {
+				return err
+			}
+			log.Debugf("Loaded ignore file: %s", ign)
+			fs.ignores[relp] = patterns
+		}
+		cfg := filepath.Join(p, DirConfigFile)
+		if fi, err := os.Stat(cfg); err == nil {
+			fs.changed[cfg] = fs.update(cfg, fi)
+			c, err := ReadDirConfig(cfg, relp, fs.PathGlobs)
+			if err != nil {
+				return err
+			}
+			// like any other file, upper layers replace it
+			log.Debugf("Loaded folder configuration: %s", cfg)
+			fs.configs[relp] = c
+		}
 		log.Debugf("Adding folder: %s", abspath)
-		fs.dirs[relp] = i.Mode()
+		delete(fs.files, relp)
+		fs.dirs[relp] = item
+	} else if name := filepath.Base(relp); name == DirConfigFile || name == IgnoreFile {
+		// already loaded with its folder, never processed
+		return nil
+	} else if strings.HasPrefix(name, WhiteoutPrefix) {
+		if name == WhiteoutOpaque {
+			fs.whiteout(relp, true)
+		} else {
+			fs.whiteout(filepath.Join(filepath.Dir(relp), strings.TrimPrefix(name, WhiteoutPrefix)), false)
+		}
 	} else if i.Mode().IsRegular() || i.Mode()&os.ModeSymlink != 0 {
-		if fs.SkipFileGlob != nil && fs.SkipFileGlob.MatchString(relp) {
+		if fs.SkipFileGlob.MatchString(relp) {
 			fs.skippedFiles = append(fs.skippedFiles, relp)
 			log.Debugf("Skipping file due to glob '%s': %s", fs.SkipFileGlob.String(), relp)
 			return nil
-		} else if fs.FileGlob != nil && !fs.FileGlob.MatchString(relp) {
+		} else if len(fs.FileGlob) > 0 && !fs.FileGlob.MatchString(relp) {
 			fs.skippedFiles = append(fs.skippedFiles, relp)
 			log.Debugf("Skipping file due to not matching glob '%s': %s", fs.FileGlob.String(), relp)
 			return nil
+		} else if fs.ignored(relp, false) {
+			fs.skippedFiles = append(fs.skippedFiles, relp)
+			return nil
 		}
 		log.Debugf("Adding file: %s", abspath)
-		fs.files[relp] = i.Mode()
+		delete(fs.dirs, relp)
+		fs.files[relp] = item
 	} else {
 		log.Debugf("Skipping non regular file: %s", abspath)
 	}
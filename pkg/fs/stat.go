@@ -0,0 +1,43 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"os"
+	"time"
+)
+
+// Stat is the metadata of a source item, captured when it is scanned.
+// Uid and Gid are -1 if the platform does not provide them.
+type Stat struct {
+	Mode       os.FileMode
+	Uid        int
+	Gid        int
+	ModTime    time.Time
+	AccessTime time.Time
+}
+
+// NewStat returns the metadata of fi
+func NewStat(fi os.FileInfo) *Stat {
+	s := Stat{
+		Mode:       fi.Mode(),
+		Uid:        -1,
+		Gid:        -1,
+		ModTime:    fi.ModTime(),
+		AccessTime: fi.ModTime(),
+	}
+	sysStat(fi, &s)
+	return &s
+}
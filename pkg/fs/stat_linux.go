@@ -0,0 +1,29 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func sysStat(fi os.FileInfo, s *Stat) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		s.Uid = int(st.Uid)
+		s.Gid = int(st.Gid)
+		s.AccessTime = time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Xattrs returns the extended attributes of the path p, following links
+func Xattrs(p string) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+	size, err := unix.Listxattr(p, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return attrs, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Cannot list extended attributes of '%s': %s", p, err)
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Listxattr(p, buf); err != nil {
+		return nil, fmt.Errorf("Cannot list extended attributes of '%s': %s", p, err)
+	}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getxattr(p, string(name))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get extended attribute '%s' of '%s': %s", name, p, err)
+		}
+		attrs[string(name)] = value
+	}
+	return attrs, nil
+}
+
+func getxattr(p, name string) ([]byte, error) {
+	size, err := unix.Getxattr(p, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	if size > 0 {
+		if size, err = unix.Getxattr(p, name, value); err != nil {
+			return nil, err
+		}
+	}
+	return value[:size], nil
+}
+
+// SetXattr defines the extended attribute name of the path p
+func SetXattr(p, name string, value []byte) error {
+	if err := unix.Setxattr(p, name, value, 0); err != nil {
+		return fmt.Errorf("Cannot set extended attribute '%s' to '%s': %s", name, p, err)
+	}
+	return nil
+}
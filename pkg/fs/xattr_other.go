@@ -0,0 +1,31 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+//go:build !linux
+
+package fs
+
+import (
+	"fmt"
+)
+
+// Xattrs is only implemented in Linux, there are no attributes
+func Xattrs(p string) (map[string][]byte, error) {
+	return map[string][]byte{}, nil
+}
+
+// SetXattr is only implemented in Linux
+func SetXattr(p, name string, value []byte) error {
+	return fmt.Errorf("Cannot set extended attribute '%s' to '%s': not supported", name, p)
+}
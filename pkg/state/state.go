@@ -0,0 +1,165 @@
+// Copyright © 2019 Jose Riguera <jriguera@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Entry is a destination path created by confinit
+type Entry struct {
+	Source    string `json:"source"`
+	Operation string `json:"operation"`
+	Checksum  string `json:"checksum,omitempty"`
+	IsDir     bool   `json:"dir,omitempty"`
+}
+
+// Download keeps the HTTP cache validators of a downloaded file
+type Download struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastmodified,omitempty"`
+	Checksum     string `json:"checksum"`
+}
+
+// State keeps track of what was done in previous runs
+type State struct {
+	Updated   time.Time            `json:"updated"`
+	Created   map[string]*Entry    `json:"created"`
+	Downloads map[string]*Download `json:"downloads,omitempty"`
+	Archives  map[string]string    `json:"archives,omitempty"`
+	path      string
+}
+
+// New returns an empty state which will be saved to path
+func New(path string) *State {
+	s := State{
+		Created:   make(map[string]*Entry),
+		Downloads: make(map[string]*Download),
+		Archives:  make(map[string]string),
+		path:      path,
+	}
+	return &s
+}
+
+// Load reads the state from path, if the file does not exist it
+// returns an empty state
+func Load(path string) (*State, error) {
+	s := New(path)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return s, err
+	}
+	if err = json.Unmarshal(content, s); err != nil {
+		err = fmt.Errorf("Cannot parse state file '%s', %s", path, err)
+		return New(path), err
+	}
+	if s.Created == nil {
+		s.Created = make(map[string]*Entry)
+	}
+	if s.Downloads == nil {
+		s.Downloads = make(map[string]*Download)
+	}
+	if s.Archives == nil {
+		s.Archives = make(map[string]string)
+	}
+	return s, nil
+}
+
+// Save writes the state to a temporary file and renames it to its path
+func (s *State) Save() error {
+	s.Updated = time.Now()
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), os.FileMode(0755)); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, os.FileMode(0600)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Path returns the file where the state is stored
+func (s *State) Path() string {
+	return s.path
+}
+
+// Add records dst as created by operation from source, computing
+// its checksum if it is a regular file
+func (s *State) Add(dst, source, operation string) error {
+	fi, err := os.Lstat(dst)
+	if err != nil {
+		return err
+	}
+	e := Entry{
+		Source:    source,
+		Operation: operation,
+		IsDir:     fi.IsDir(),
+	}
+	if fi.Mode().IsRegular() {
+		if e.Checksum, err = Checksum(dst); err != nil {
+			return err
+		}
+	}
+	s.Created[dst] = &e
+	return nil
+}
+
+// Has returns true if dst was created by confinit
+func (s *State) Has(dst string) bool {
+	_, ok := s.Created[dst]
+	return ok
+}
+
+// Checksum returns the sha256 of the file content
+func Checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Modified returns true if the file at dst is not the one confinit wrote
+func (e *Entry) Modified(dst string) bool {
+	if e.IsDir || e.Checksum == "" {
+		return false
+	}
+	sum, err := Checksum(dst)
+	if err != nil {
+		return true
+	}
+	return sum != e.Checksum
+}